@@ -10,6 +10,7 @@ import (
 type Feed struct {
 	Title   string  `xml:"title"`
 	Updated string  `xml:"updated"`
+	Links   []Link  `xml:"link"`
 	Entries []Entry `xml:"entry"`
 	Raw     []byte  `xml:",innerxml"`
 }
@@ -29,6 +30,16 @@ type Link struct {
 	Rel  string `xml:"rel,attr"`
 }
 
+// Link returns the link of the feed to its site, its alternate link.
+func (f Feed) Link() string {
+	for _, link := range f.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
 func NewFeed(data []byte) (*Feed, error) {
 
 	if !IsFeed(data) {
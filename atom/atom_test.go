@@ -11,6 +11,7 @@ func TestSlashdot(t *testing.T) {
 	expected := Feed{
 		Title:   "Slashdot",
 		Updated: "2015-04-26T09:21:17+00:00",
+		Links:   []Link{Link{Href: "http://slashdot.org/"}},
 		Entries: []Entry{
 			Entry{
 				Title: "Declassified Report From 2009 Questions Effectiveness of NSA Spying",
@@ -32,6 +33,7 @@ func TestTheVerge(t *testing.T) {
 	expected := Feed{
 		Title:   "The Verge -  All Posts",
 		Updated: "2015-04-26T02:01:02-04:00",
+		Links:   []Link{Link{Href: "http://www.theverge.com/", Rel: "alternate"}},
 		Entries: []Entry{
 			Entry{
 				Title: "These old school electric bicycles look like a 1950s dream",
@@ -55,6 +57,7 @@ func TestXKCD(t *testing.T) {
 	expected := Feed{
 		Title:   "xkcd.com",
 		Updated: "2015-04-24T00:00:00Z",
+		Links:   []Link{Link{Href: "http://xkcd.com/", Rel: "alternate"}},
 		Entries: []Entry{
 			Entry{
 				Title: "Win by Induction",
@@ -100,6 +103,7 @@ func (tc TestCase) Test(t *testing.T) {
 func (tc TestCase) TestFeed(t *testing.T) {
 	expect(tc.Actual.Title, tc.Expected.Title, t)
 	expect(tc.Actual.Updated, tc.Expected.Updated, t)
+	expect(tc.Actual.Link(), tc.Expected.Link(), t)
 }
 
 func (tc TestCase) TestEntry(t *testing.T) {
@@ -5,4 +5,4 @@ export PGUSER=postgres
 export PGDATABASE=postgres
 export REDISHOST=$REDIS_PORT_6379_TCP_ADDR
 export REDISPORT=$REDIS_PORT_6379_TCP_PORT
-go run *.go
\ No newline at end of file
+go build -o /tmp/nimbus && exec /tmp/nimbus
\ No newline at end of file
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/bearfrieze/nimbus/nimbus"
-	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,14 +27,42 @@ const (
 	workerCount     = 80
 	queueLimit      = 1000
 	invalidDuration = 24 * 7 // One week
+	popularityLife  = 24 * time.Hour
+	popularityLimit = 100000 // Feeds counted at most
+	leaseDuration   = 2 * time.Minute
+	shutdownTimeout = 20 * time.Second
+	maxRefreshWait  = 30 // Seconds
+	refreshLimit    = 20 // Feeds refreshed per request at most
+	refreshRate     = 60 // Feeds refreshed per client per round of polling
+	pendingDuration = 60 // Seconds
+	pendingGrace    = 20 * time.Second
+	pruneFrequency  = time.Hour
+	pruneBatch      = 1000
+	prunePause      = time.Second
+	searchLimit     = 20
+	maxSearchLimit  = 100
+
+	degradedLimit = 10000 // Unknown feeds marked pending here while the cache is down
+
+	duplicateCandidates = 10   // Feeds compared with each polled feed at most
+	duplicateConfidence = 0.75 // Needed to alias a feed to its duplicate
 )
 
 var (
-	ca     *nimbus.Cache
-	db     *gorm.DB
-	client *http.Client
-	queued map[string]bool = make(map[string]bool)
-	queue  chan string     = make(chan string, queueLimit)
+	ca         nimbus.Cache
+	st         nimbus.Store
+	client     *http.Client
+	popularity *nimbus.Popularity = nimbus.NewPopularity(popularityLife, popularityLimit)
+	scheduler  *nimbus.Scheduler
+	lease      *nimbus.Lease
+	adminToken string
+	degraded   *nimbus.MemoryCache = nimbus.NewMemoryCache(degradedLimit)
+	refreshes  map[string]int      = make(map[string]int) // By client, this round
+	refreshing sync.Mutex
+	shared     *nimbus.RedisCache // Shared with other instances when distributed
+	proxies    []*net.IPNet       // Trusted to tell the address of clients
+	pruning    sync.Mutex         // Held while a pass of pruning runs
+	stopping   chan struct{}      = make(chan struct{})
 )
 
 type logData map[string]interface{}
@@ -37,6 +72,15 @@ func logJson(data logData) {
 	log.Println(string(marshalled))
 }
 
+// goneError is returned for feeds that their server says do not exist.
+type goneError struct {
+	status string
+}
+
+func (e goneError) Error() string {
+	return fmt.Sprintf("Feed is gone: %s", e.status)
+}
+
 func fetchFeed(url string) (*nimbus.Feed, error) {
 	if len(url) == 0 {
 		return nil, fmt.Errorf("Don't fetch the empty url")
@@ -45,148 +89,257 @@ func fetchFeed(url string) (*nimbus.Feed, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to fetch %s: %s", url, err)
 	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone {
+		return nil, goneError{r.Status}
+	}
 	data, _ := ioutil.ReadAll(r.Body)
 	return nimbus.NewFeed(url, data)
 }
 
+// findFeed tells a feed that isn't stored apart from a failed lookup.
+func findFeed(dbFeed *nimbus.Feed, err error) (*nimbus.Feed, bool, error) {
+	if err == nimbus.ErrNotFound {
+		return nil, false, nil
+	}
+	return dbFeed, err == nil, err
+}
+
 func saveFeed(feed *nimbus.Feed) error {
 
-	dbFeed := nimbus.Feed{URL: feed.URL}
-	dbFeedFound := !db.Where(&dbFeed).First(&dbFeed).RecordNotFound()
-	dbDuplicate := nimbus.Feed{Sum: feed.Sum}
-	dbDuplicateFound := !db.Where(&dbDuplicate).First(&dbDuplicate).RecordNotFound()
+	feed.FetchedAt = time.Now()
 
-	if dbDuplicateFound && !(dbFeedFound && dbFeed.ID == dbDuplicate.ID) {
-		createAlias(&dbFeed, &dbDuplicate, dbFeedFound)
-		return fmt.Errorf("Duplicate %s found, alias created", dbDuplicate.URL)
+	dbFeed, dbFeedFound, err := findFeed(st.Feed(feed.URL))
+	if err != nil {
+		return err
+	}
+	dbDuplicate, err := findDuplicate(feed)
+	if err != nil {
+		return err
+	}
+
+	// A feed that can't be aliased, which createAlias logs, is saved as is
+	if dbDuplicate != nil {
+		alias := dbFeed
+		if !dbFeedFound {
+			alias = &nimbus.Feed{URL: feed.URL}
+		}
+		if _, err := createAlias(alias, dbDuplicate, dbFeedFound); err == nil {
+			return fmt.Errorf("Duplicate %s found, alias created", dbDuplicate.URL)
+		}
 	}
 
 	if !dbFeedFound {
 		log.Printf("Creating %s\n", feed.URL)
-		db.Create(&feed)
-		return nil
+		feed.RequestedAt = time.Now()
+		return st.SaveFeed(feed, nil)
 	}
 
 	feed.ID = dbFeed.ID
-	db.Omit("Items", "CreatedAt").Save(&feed)
 
-	db.Model(&dbFeed).Related(&dbFeed.Items)
+	// Dormant feeds are only polled when requested, which revives them
+	feed.RequestedAt = dbFeed.RequestedAt
+	if dbFeed.Dormant {
+		logJson(logData{"event": "revive", "url": feed.URL})
+		feed.RequestedAt = time.Now()
+	}
 
-	// Compare items to existing items
-	// Update existing items and create new ones
-	dbItems := make(map[string]int, len(dbFeed.Items))
-	for _, dbItem := range dbFeed.Items {
-		dbItems[dbItem.GUID] = dbItem.ID
+	// Schedule the next poll from what previous polls have found
+	return st.SaveFeed(feed, func(found int) {
+		activity := nimbus.ParseActivity(dbFeed.Activity)
+		activity.Observe(found, time.Now())
+		feed.Activity = activity.String()
+		feed.NextPollAt = time.Now().Add(activity.Timeout(time.Now(), feed.Timeout()))
+	})
+}
+
+// findDuplicate returns the stored feed that a feed most confidently
+// duplicates, if any is above duplicateConfidence, logging the evidence that
+// it is one. Feeds that had their alias undone are kept
+// apart from their duplicates.
+func findDuplicate(feed *nimbus.Feed) (*nimbus.Feed, error) {
+
+	if separate, err := unaliased(feed.URL); err != nil || separate {
+		return nil, err
+	}
+	candidates, err := st.DuplicateCandidates(feed, duplicateCandidates)
+	if err != nil {
+		return nil, err
 	}
-	for _, item := range feed.Items {
-		dbID, exists := dbItems[item.GUID]
-		if !exists {
-			item.FeedID = dbFeed.ID
-			db.Create(&item)
+
+	var duplicate *nimbus.Feed
+	var evidence nimbus.Duplication
+	for i := range candidates {
+		candidate := &candidates[i]
+		separate, err := unaliased(candidate.URL)
+		if err != nil {
+			return nil, err
+		}
+		if separate {
 			continue
 		}
-		item.ID = dbID
-		db.Omit("GUID", "FeedID", "PublishedAt", "CreatedAt").Save(&item)
+		if candidate.Items, err = st.Items(candidate.ID, nimbus.DuplicateSample); err != nil {
+			return nil, err
+		}
+		compared := nimbus.CompareFeeds(feed, candidate)
+		if compared.Confidence >= duplicateConfidence && compared.Confidence >= evidence.Confidence {
+			duplicate, evidence = candidate, compared
+		}
 	}
-	return nil
+	if duplicate != nil {
+		logJson(logData{"event": "duplicateEvidence", "url": feed.URL, "candidate": duplicate.URL, "evidence": evidence})
+	}
+	return duplicate, nil
 }
 
-func createAlias(alias *nimbus.Feed, original *nimbus.Feed, delete bool) {
+// createAlias points a feed at its original, deleting the feed if it is
+// stored. The alias is pointed at the end of the chain of the original, and
+// isn't created if that leads back to the feed.
+func createAlias(alias *nimbus.Feed, original *nimbus.Feed, delete bool) (*nimbus.Alias, error) {
 
-	if alias.URL == original.URL {
-		return
-	}
 	logJson(logData{"event": "alias", "alias": alias.URL, "original": original.URL})
-	db.Create(&nimbus.Alias{Alias: alias.URL, Original: original.URL})
+	created := &nimbus.Alias{Alias: alias.URL, Original: original.URL}
+	if err := st.CreateAlias(created); err != nil {
+		logJson(logData{"event": "aliasFail", "alias": alias.URL, "err": err.Error()})
+		return nil, err
+	}
 
-	ca.SetAlias(alias.URL, original.URL)
+	if err := ca.SetAlias(created.Alias, created.Original); err != nil {
+		logJson(logData{"event": "cacheFail", "alias": alias.URL, "err": err.Error()})
+	}
 
 	if delete {
 		logJson(logData{"event": "delete", "url": alias.URL})
 		deleteFeed(alias)
 	}
+	return created, nil
+}
+
+// unaliased tells if a feed had its alias undone, which keeps it from being
+// aliased again.
+func unaliased(url string) (bool, error) {
+	alias, err := st.Alias(url)
+	if err == nimbus.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return alias.Unaliased, nil
 }
 
 func deleteFeed(feed *nimbus.Feed) {
-	db.Where(&nimbus.Alias{Original: feed.URL}).Delete(nimbus.Alias{})
-	db.Where(&nimbus.Item{FeedID: feed.ID}).Delete(nimbus.Item{})
-	db.Delete(feed)
+	if err := st.DeleteFeed(feed); err != nil {
+		logJson(logData{"event": "deleteFail", "url": feed.URL, "err": err.Error()})
+	}
 }
 
-func worker() {
-	for {
-		url := <-queue
-		delete(queued, url)
-		pollFeed(url)
+// claimFeed polls a feed unless another instance has claimed it, or has just
+// finished polling it and it is not being refreshed.
+func claimFeed(url string, refresh bool) error {
+
+	claimed, err := lease.Acquire(url)
+	if err != nil {
+		logJson(logData{"event": "leaseFail", "url": url, "err": err.Error()})
+		return err
+	}
+	if !claimed {
+		logJson(logData{"event": "leaseTaken", "url": url})
+		return nil
 	}
+	defer lease.Release(url)
+
+	nextPoll := time.Now().Add((pollFrequency + 1) * time.Second)
+	if dbFeed, err := st.Feed(url); !refresh && err == nil && dbFeed.NextPollAt.After(nextPoll) {
+		return nil
+	}
+
+	_, err = pollFeed(url)
+	return err
 }
 
-func pollFeed(url string) {
+// pollFeed fetches, parses and saves a feed. The scheduler never polls a feed
+// twice at once.
+func pollFeed(url string) (*nimbus.Feed, error) {
 	logJson(logData{"event": "poll", "url": url})
 	logJson(logData{"event": "fetch", "url": url})
 	feed, err := fetchFeed(url)
 	if err != nil {
 		logJson(logData{"event": "fetchFail", "url": url, "err": err.Error()})
-		dbFeed := nimbus.Feed{URL: url}
-		if db.Where(&dbFeed).First(&dbFeed).RecordNotFound() {
-			ca.Set(url, "false")
-			ca.Expire(url, int(invalidDuration*time.Hour/time.Second))
-		} else {
-			dbFeed.NextPollAt = time.Now().Add(invalidDuration * time.Hour)
-			db.Omit("Items", "CreatedAt").Save(&dbFeed)
+		_, gone := err.(goneError)
+		retryAt := time.Now().Add(invalidDuration * time.Hour)
+		dbFeed, dbErr := st.Feed(url)
+		switch dbErr {
+		case nimbus.ErrNotFound:
+			failure := &nimbus.Failure{Error: err.Error(), Gone: gone, RetryAt: retryAt}
+			if err := ca.MarkInvalid(url, failure); err != nil {
+				logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+			}
+		case nil:
+			dbFeed.NextPollAt = retryAt
+			dbFeed.LastError = err.Error()
+			dbFeed.Gone = gone
+			st.UpdateFeed(dbFeed)
 			setFeedInCache(url)
 		}
-	} else {
-		logJson(logData{"event": "save", "url": url})
-		if err = saveFeed(feed); err != nil {
-			logJson(logData{"event": "saveFail", "url": url, "err": err.Error()})
-			return
-		}
-		setFeedInCache(url)
+		logJson(logData{"event": "pollEnd", "url": url})
+		return nil, err
 	}
-	logJson(logData{"event": "pollEnd", "url": url})
-}
-
-func queueFeed(url string) bool {
-	if _, exists := queued[url]; exists {
-		return true
-	}
-	select {
-	case queue <- url:
-		queued[url] = true
-		return true
-	default:
-		logJson(logData{"event": "queueFull"})
-		return false
+	logJson(logData{"event": "save", "url": url})
+	if err = saveFeed(feed); err != nil {
+		logJson(logData{"event": "saveFail", "url": url, "err": err.Error()})
+		return nil, err
 	}
+	setFeedInCache(url)
+	logJson(logData{"event": "pollEnd", "url": url})
+	return feed, nil
 }
 
 func pollFeeds() {
 
-	var urls []string
 	var nextPoll = time.Now().Add((pollFrequency + 1) * time.Second)
-	db.Model(&nimbus.Feed{}).Where("next_poll_at < ?", nextPoll).Pluck("url", &urls)
+	feeds, err := st.DueFeeds(nextPoll)
+	if err != nil {
+		logJson(logData{"event": "dueFail", "err": err.Error()})
+		return
+	}
 
-	for _, url := range urls {
-		if !queueFeed(url) {
-			break
+	rejected := 0
+	for _, feed := range feeds {
+		if !scheduler.Enqueue(feed.URL, feed.NextPollAt) {
+			rejected++
 		}
 	}
+	if rejected > 0 {
+		logJson(logData{"event": "queueFull", "rejected": rejected})
+	}
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+// acceptPost lets any origin post to an endpoint, answering preflight requests
+// and refusing other methods. It tells if there is a post to handle.
+func acceptPost(w http.ResponseWriter, r *http.Request) bool {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(200)
-		return
+		return false
 	}
 
 	if r.Method != "POST" {
 		http.Error(w, fmt.Sprintf("Unsupported method '%s'\n", r.Method), 501)
-		return
+		return false
+	}
+
+	return true
+}
+
+// decodeRequest reads the list of feed urls posted to any of the endpoints.
+func decodeRequest(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+
+	if !acceptPost(w, r) {
+		return nil, false
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -195,56 +348,877 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Unable to decode request: %s\n", err)
 		http.Error(w, err.Error(), 400)
-		return
+		return nil, false
 	}
 
-	response, missing := ca.GetFeeds(urls)
-	json, err := json.Marshal(&response)
+	return urls, true
+}
+
+// writeFeeds responds with the feeds as they are cached, compressed with gzip
+// if the client accepts it. Feeds are cached compressed, so they are passed
+// on without being decompressed.
+func writeFeeds(w http.ResponseWriter, r *http.Request, urls []string) {
+
+	response := lookupFeeds(clientAddress(r), urls)
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	compress := acceptsGzip(r)
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if err := nimbus.WriteValues(w, response, compress); err != nil {
+		log.Printf("Unable to write response: %s\n", err)
+	}
+}
+
+// acceptsGzip tells if a request accepts responses compressed with gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		if len(parts) > 1 {
+			if q := strings.TrimSpace(parts[1]); strings.HasPrefix(q, "q=") {
+				if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeStatuses responds with the status of every feed, around the feed.
+func writeStatuses(w http.ResponseWriter, r *http.Request, urls []string) {
+
+	response := lookupFeeds(clientAddress(r), urls)
+	invalid := make([]string, 0)
+	for url, value := range response {
+		if string(value) == "false" {
+			invalid = append(invalid, url)
+		}
+	}
+	failures, err := ca.GetFailures(invalid)
+	if err != nil {
+		logJson(logData{"event": "cacheFail", "err": err.Error()})
+	}
+
+	statuses := make(map[string]*nimbus.Status)
+	for url, value := range response {
+		feed, err := value.JSON()
+		if err != nil {
+			logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+			feed = json.RawMessage("true")
+		}
+		statuses[url] = nimbus.NewStatus(url, &feed, failures[url])
+	}
+	json, err := json.Marshal(statuses)
 	if err != nil {
 		log.Printf("Unable to marshal response: %s\n", err)
 	}
+	w.Write(json)
+}
+
+// lookupFeeds returns the cached feeds, reading those missing from the cache
+// from the store, and queues the feeds that are not stored. If the cache is
+// unavailable every feed is read from the store. Every feed counts as
+// requested by the client, under the url it is an alias of.
+func lookupFeeds(client string, urls []string) map[string]nimbus.Value {
 
+	response, missing, originals, err := ca.GetFeeds(urls)
+	cached := err == nil
+	if !cached {
+		logJson(logData{"event": "cacheUnavailable", "err": err.Error()})
+		response, missing = make(map[string]nimbus.Value), urls
+	}
+
+	read := make(map[string]bool, len(missing))
 	for _, url := range missing {
-		ca.Set(url, "true")
-		ca.Expire(url, 60)
-		if !queueFeed(url) {
+		read[url] = true
+	}
+	for _, url := range urls {
+		if !read[url] {
+			popularity.Hit(originals[url], client)
+		}
+	}
+
+	stored, unknown, dormant := readFeeds(client, missing, cached)
+	for url, value := range stored {
+		response[url] = value
+	}
+
+	// Without the cache unknown feeds are only marked pending on this instance,
+	// so that they are not queued again on every request either
+	var marker nimbus.Cache = ca
+	if !cached {
+		marker = degraded
+	}
+	for _, url := range unknown {
+		// Another request or a finished poll may have got here first
+		marked, err := marker.MarkPending(url, pendingDuration)
+		if err != nil {
+			logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+		} else if !marked {
+			continue
+		}
+		enqueueFeed(url)
+	}
+
+	// Requesting a dormant feed revives it
+	for _, url := range dormant {
+		enqueueFeed(url)
+	}
+
+	return response
+}
+
+// enqueueFeed polls a feed somebody has asked for ahead of those merely due.
+func enqueueFeed(url string) {
+	if !scheduler.Request(url) {
+		logJson(logData{"event": "queueFull", "url": url})
+	}
+}
+
+// readFeeds reads feeds from the store, along with their aliases, caching
+// them if it can, and counts them as requested by the client. Feeds that are
+// not stored are returned as unknown and dormant feeds to be revived. Marking
+// them requested revives them in the store too, and they are only cached once
+// it has, so that they are read again until then. Feeds that could not be read
+// are neither, so they are pending without being polled again.
+func readFeeds(client string, urls []string, cache bool) (map[string]nimbus.Value, []string, []string) {
+
+	response := make(map[string]nimbus.Value)
+	unknown := make([]string, 0)
+	dormant := make([]string, 0)
+	requested := make([]string, 0, len(urls))
+
+	for _, url := range urls {
+		value := json.RawMessage("true")
+		feed, err := storedFeed(url)
+		if err == nil {
+			popularity.Hit(feed.URL, client)
+			requested = append(requested, feed.URL)
+			if feed.Dormant {
+				dormant = append(dormant, feed.URL)
+			}
+			value, err = json.Marshal(feed)
+		}
+		if err == nil && cache && !feed.Dormant {
+			cacheFeed(url, feed)
+		}
+		switch {
+		case err == nimbus.ErrNotFound:
+			popularity.Hit(url, client)
+			unknown = append(unknown, url)
+		case err != nil:
+			logJson(logData{"event": "readFail", "url": url, "err": err.Error()})
+			value = json.RawMessage("true")
+		}
+		response[url] = nimbus.Value(value)
+	}
+
+	if len(requested) > 0 {
+		if err := st.MarkRequested(requested, time.Now()); err != nil {
+			logJson(logData{"event": "requestedFail", "err": err.Error()})
+		}
+	}
+
+	return response, unknown, dormant
+}
+
+// cacheFeed caches a feed read from the store, and the alias it was read by.
+// A poll finishing meanwhile may have cached a newer feed, which is kept.
+func cacheFeed(url string, feed *nimbus.Feed) {
+	logJson(logData{"event": "readThrough", "url": url})
+	err := ca.AddFeed(feed.URL, feed)
+	if err == nil && url != feed.URL {
+		err = ca.SetAlias(url, feed.URL)
+	}
+	if err != nil {
+		logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+	}
+}
+
+// markRequested records when feeds were last requested, as seen by the cache.
+func markRequested() {
+	urls, err := ca.TakeRequested()
+	if err != nil {
+		logJson(logData{"event": "requestedFail", "err": err.Error()})
+		return
+	}
+	if len(urls) == 0 {
+		return
+	}
+	if err = st.MarkRequested(urls, time.Now()); err != nil {
+		logJson(logData{"event": "requestedFail", "err": err.Error()})
+	}
+}
+
+// sharePopularity starts a new round of counting popularity. With Redis the
+// hits of every instance are counted together, so that a feed is as popular
+// to each as to all of them.
+func sharePopularity() {
+	var share func(map[string]float64) (map[string]float64, error)
+	if redisCache, ok := remoteCache(); ok {
+		share = func(hits map[string]float64) (map[string]float64, error) {
+			return redisCache.SharePopularity(hits, popularityLife, popularityLimit)
+		}
+	}
+	if err := popularity.Round(share); err != nil {
+		logJson(logData{"event": "cacheFail", "err": err.Error()})
+	}
+}
+
+// sweepPending polls the feeds this instance marked pending a while ago that
+// it hasn't scheduled, as when their poll was lost. Feeds marked by other
+// instances are left to them. Should one go down, its markers expire within
+// pendingDuration and the next request for one of its feeds marks it anew.
+func sweepPending() {
+	urls, err := ca.Pending(time.Now().Add(-pendingGrace))
+	if err != nil {
+		logJson(logData{"event": "cacheFail", "err": err.Error()})
+		return
+	}
+	for _, url := range urls {
+		if !scheduler.Scheduled(url) {
+			logJson(logData{"event": "pendingSwept", "url": url})
+			enqueueFeed(url)
+		}
+	}
+}
+
+// sweepDormant stops polling feeds nobody has requested for a while and
+// evicts them from the cache, so the next request for one of them revives it.
+func sweepDormant(idle time.Duration) {
+	urls, err := st.MarkDormant(time.Now().Add(-idle))
+	if err != nil {
+		logJson(logData{"event": "dormantFail", "err": err.Error()})
+	}
+	for _, url := range urls {
+		logJson(logData{"event": "dormant", "url": url})
+		if err := ca.Delete(url); err != nil {
+			logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+		}
+	}
+}
+
+// pruneItems deletes the items the retention policy does not keep, one feed
+// at a time and pausing between batches so that saves are not held up for
+// long. Dormant feeds are left alone, as they gain no items. It stops between
+// batches when shutting down.
+func pruneItems(retention nimbus.Retention) {
+	pruning.Lock()
+	defer pruning.Unlock()
+	urls, err := st.FeedURLs()
+	if err != nil {
+		logJson(logData{"event": "pruneFail", "err": err.Error()})
+		return
+	}
+	total := 0
+pruning:
+	for _, url := range urls {
+		feed, err := st.Feed(url)
+		if err == nimbus.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			logJson(logData{"event": "pruneFail", "url": url, "err": err.Error()})
 			break
 		}
+		for {
+			pruned, err := st.PruneItems(feed, retention, pruneBatch)
+			total += pruned
+			if err != nil {
+				logJson(logData{"event": "pruneFail", "url": url, "err": err.Error()})
+				break pruning
+			}
+			if pruned < pruneBatch {
+				break
+			}
+			select {
+			case <-stopping:
+				break pruning
+			case <-time.After(prunePause):
+			}
+		}
+		select {
+		case <-stopping:
+			break pruning
+		default:
+		}
 	}
+	logJson(logData{"event": "prune", "items": total})
+}
 
+func handler(w http.ResponseWriter, r *http.Request) {
+	urls, ok := decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	writeFeeds(w, r, urls)
+}
+
+// statusHandler is the handler answering with the status of every feed.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	urls, ok := decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	writeStatuses(w, r, urls)
+}
+
+// refreshHandler polls the requested feeds ahead of all others. Given a wait
+// in seconds it responds once they have been polled or the wait is over. Each
+// client refreshes at most refreshRate feeds every round of polling, and at
+// most refreshLimit at a time.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+
+	urls, ok := decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(urls) > refreshLimit {
+		http.Error(w, fmt.Sprintf("Refresh at most %d feeds at a time\n", refreshLimit), 400)
+		return
+	}
+	if !allowRefresh(r, len(urls)) {
+		http.Error(w, "Too many refreshes, try again in a minute\n", 429)
+		return
+	}
+
+	polled := make([]<-chan error, len(urls))
+	for i, url := range urls {
+		logJson(logData{"event": "refresh", "url": url})
+		polled[i] = scheduler.Refresh(url)
+	}
+
+	wait, _ := strconv.Atoi(r.URL.Query().Get("wait"))
+	if wait > maxRefreshWait {
+		wait = maxRefreshWait
+	}
+	if wait > 0 {
+		timeout := time.After(time.Duration(wait) * time.Second)
+	waiting:
+		for i, done := range polled {
+			select {
+			case err := <-done:
+				if err != nil {
+					logJson(logData{"event": "refreshFail", "url": urls[i], "err": err.Error()})
+				}
+			case <-timeout:
+				break waiting
+			}
+		}
+	}
+
+	writeFeeds(w, r, urls)
+}
+
+// allowRefresh counts the feeds a client refreshes, telling if it is within
+// refreshRate for the round. Instances sharing Redis count every refresh
+// together, and fall back on counting their own if it can't be reached.
+func allowRefresh(r *http.Request, feeds int) bool {
+	client := clientAddress(r)
+	if shared != nil {
+		allowed, err := shared.CountRefreshes(client, feeds, refreshRate, pollFrequency)
+		if err == nil {
+			return allowed
+		}
+		logJson(logData{"event": "cacheFail", "client": client, "err": err.Error()})
+	}
+	refreshing.Lock()
+	defer refreshing.Unlock()
+	if refreshes[client]+feeds > refreshRate {
+		return false
+	}
+	refreshes[client] += feeds
+	return true
+}
+
+// clientAddress tells clients apart by address. Requests passed on by trusted
+// proxies are from the last address in X-Forwarded-For that isn't one.
+func clientAddress(r *http.Request) string {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(address); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			address = hop
+		}
+	}
+	return address
+}
+
+// trustedProxy tells if an address is that of a trusted proxy.
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	for _, proxy := range proxies {
+		if ip != nil && proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxies parses a comma separated list of addresses and networks.
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, address := range splitAddresses(list) {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid proxy address '%s'", address)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy network '%s'", address)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// resetRefreshes starts a new round of refreshes.
+func resetRefreshes() {
+	refreshing.Lock()
+	defer refreshing.Unlock()
+	refreshes = make(map[string]int)
+}
+
+// searchHandler responds with a page of the items matching a posted query,
+// best match first.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !acceptPost(w, r) {
+		return
+	}
+
+	var query nimbus.SearchQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		log.Printf("Unable to decode search: %s\n", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if strings.TrimSpace(query.Text) == "" {
+		http.Error(w, "Search for something\n", 400)
+		return
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	if query.Limit <= 0 {
+		query.Limit = searchLimit
+	} else if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+
+	results, err := st.Search(query)
+	if err != nil {
+		logJson(logData{"event": "searchFail", "query": query.Text, "err": err.Error()})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("Unable to marshal results: %s\n", err)
+	}
 	w.Write(json)
 }
 
+// historyHandler responds with an item of a feed, given by the url and guid
+// query parameters, and what it said before each change to it.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("Unsupported method '%s'\n", r.Method), 501)
+		return
+	}
+
+	url, guid := r.URL.Query().Get("url"), r.URL.Query().Get("guid")
+	feed, err := st.Feed(url)
+	var item *nimbus.Item
+	if err == nil {
+		item, err = st.Item(feed.ID, guid)
+	}
+	var revisions []nimbus.Revision
+	if err == nil {
+		revisions, err = st.Revisions(item.ID)
+	}
+	switch err {
+	case nil:
+	case nimbus.ErrNotFound:
+		http.Error(w, fmt.Sprintf("No item '%s' in feed '%s'\n", guid, url), 404)
+		return
+	default:
+		logJson(logData{"event": "historyFail", "url": url, "guid": guid, "err": err.Error()})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json, err := json.Marshal(map[string]interface{}{"item": item, "revisions": revisions})
+	if err != nil {
+		log.Printf("Unable to marshal history: %s\n", err)
+	}
+	w.Write(json)
+}
+
+// adminOnly serves the requests bearing the admin token, and none if there is
+// no token.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized\n", 401)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// aliasesHandler lists every alias on GET, aliases a feed to another on POST
+// of {"alias": <url>, "original": <url>} and removes the alias of a feed on
+// DELETE with ?alias=<url>. Removed aliases are created again if the feeds
+// still turn out to be duplicates. Aliasing a stored feed deletes it along
+// with its items for good: removing or undoing the alias only has the feed
+// polled afresh, so the original must be a stored feed.
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		aliases, err := st.Aliases()
+		if err != nil {
+			logJson(logData{"event": "aliasesFail", "err": err.Error()})
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json, err := json.Marshal(aliases)
+		if err != nil {
+			log.Printf("Unable to marshal aliases: %s\n", err)
+		}
+		w.Write(json)
+
+	case "POST":
+		var alias nimbus.Alias
+		if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+			log.Printf("Unable to decode alias: %s\n", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if alias.Alias == "" || alias.Original == "" {
+			http.Error(w, "Both alias and original must be given\n", 400)
+			return
+		}
+		original, err := st.Original(alias.Original)
+		if err == nimbus.ErrNotFound {
+			original, err = alias.Original, nil
+		}
+		if err == nil {
+			_, err = st.Feed(original)
+		}
+		switch err {
+		case nil:
+		case nimbus.ErrNotFound:
+			http.Error(w, fmt.Sprintf("No feed '%s' to alias to\n", alias.Original), 404)
+			return
+		case nimbus.ErrAliasCycle:
+			http.Error(w, fmt.Sprintf("'%s' leads back to itself\n", alias.Original), 409)
+			return
+		default:
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		dbFeed, dbFeedFound, err := findFeed(st.Feed(alias.Alias))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !dbFeedFound {
+			dbFeed = &nimbus.Feed{URL: alias.Alias}
+		}
+		created, err := createAlias(dbFeed, &nimbus.Feed{URL: alias.Original}, dbFeedFound)
+		switch err {
+		case nil:
+		case nimbus.ErrAliasCycle:
+			http.Error(w, fmt.Sprintf("'%s' leads back to '%s'\n", alias.Original, alias.Alias), 409)
+			return
+		default:
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json, err := json.Marshal(created)
+		if err != nil {
+			log.Printf("Unable to marshal alias: %s\n", err)
+		}
+		w.WriteHeader(201)
+		w.Write(json)
+
+	case "DELETE":
+		url := r.URL.Query().Get("alias")
+		logJson(logData{"event": "removeAlias", "alias": url})
+		forgetAlias(w, url, st.DeleteAlias(url))
+
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported method '%s'\n", r.Method), 501)
+	}
+}
+
+// unaliasHandler undoes a wrong alias on POST with ?alias=<url>, polling the
+// feed as one of its own and never aliasing it again.
+func unaliasHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Unsupported method '%s'\n", r.Method), 501)
+		return
+	}
+
+	url := r.URL.Query().Get("alias")
+	logJson(logData{"event": "unalias", "alias": url})
+	if forgetAlias(w, url, st.Unalias(url)) {
+		enqueueFeed(url)
+	}
+}
+
+// starHandler stars the item of a feed given by the url and guid query
+// parameters on POST, keeping it from being pruned, and unstars it on DELETE.
+func starHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, fmt.Sprintf("Unsupported method '%s'\n", r.Method), 501)
+		return
+	}
+
+	url, guid := r.URL.Query().Get("url"), r.URL.Query().Get("guid")
+	feed, err := st.Feed(url)
+	if err == nil {
+		err = st.StarItem(feed.ID, guid, r.Method == "POST")
+	}
+	switch err {
+	case nil:
+	case nimbus.ErrNotFound:
+		http.Error(w, fmt.Sprintf("No item '%s' in feed '%s'\n", guid, url), 404)
+		return
+	default:
+		logJson(logData{"event": "starFail", "url": url, "guid": guid, "err": err.Error()})
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	logJson(logData{"event": "star", "url": url, "guid": guid, "starred": r.Method == "POST"})
+	w.WriteHeader(204)
+}
+
+// forgetAlias responds to the removal of an alias from the store, dropping it
+// from the cache as well if it went through.
+func forgetAlias(w http.ResponseWriter, url string, err error) bool {
+	switch err {
+	case nil:
+	case nimbus.ErrNotFound:
+		http.Error(w, fmt.Sprintf("No alias '%s'\n", url), 404)
+		return false
+	default:
+		logJson(logData{"event": "aliasFail", "alias": url, "err": err.Error()})
+		http.Error(w, err.Error(), 500)
+		return false
+	}
+	if err := ca.DeleteAlias(url); err != nil {
+		logJson(logData{"event": "cacheFail", "alias": url, "err": err.Error()})
+	}
+	w.WriteHeader(204)
+	return true
+}
+
+// storedFeed reads a feed, or the feed it is an alias of, and its newest
+// items, as they are cached.
+func storedFeed(url string) (*nimbus.Feed, error) {
+	feed, err := st.Feed(url)
+	if err == nimbus.ErrNotFound {
+		var original string
+		if original, err = st.Original(url); err == nil {
+			feed, err = st.Feed(original)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	feed.Items, err = st.Items(feed.ID, itemLimit)
+	return feed, err
+}
+
+// setFeedInCache caches a feed as it is stored. Dormant feeds are left out, so
+// that the next request for one revives it.
 func setFeedInCache(url string) {
 	logJson(logData{"event": "cache", "url": url})
-	feed := nimbus.Feed{URL: url}
-	db.Where(&feed).First(&feed)
-	db.Model(&feed).Order("published_at desc").Limit(itemLimit).Related(&feed.Items)
-	ca.SetFeed(url, &feed)
+	feed, err := storedFeed(url)
+	if err == nil && feed.Dormant {
+		return
+	}
+	if err == nil {
+		err = ca.SetFeed(url, feed)
+	}
+	if err != nil {
+		logJson(logData{"event": "cacheFail", "url": url, "err": err.Error()})
+	}
 }
 
-func newDb() *gorm.DB {
+func newStore(kind string, data string) nimbus.Store {
+
+	if kind == "memory" {
+		log.Println("Keeping feeds in memory")
+		return nimbus.NewMemoryStore()
+	}
+
+	db := openDatabase(kind, data)
+	if err := db.Migrate(nimbus.LatestVersion()); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	return db
+}
+
+// openDatabase connects to the sqlite or postgres database, as is.
+func openDatabase(kind string, data string) *nimbus.SQLStore {
+
+	if kind == "sqlite" {
+		path := filepath.Join(data, "nimbus.db")
+		log.Printf("Opening sqlite: %s\n", path)
+		db, err := nimbus.NewSQLiteStore(path)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		return db
+	}
 
 	args := fmt.Sprintf("sslmode=disable host=%s port=%s dbname=%s user=%s password=%s", os.Getenv("PGHOST"), os.Getenv("PGPORT"), os.Getenv("PGDATABASE"), os.Getenv("PGUSER"), os.Getenv("PGPASSWORD"))
 	log.Printf("Connecting to postgres: %s\n", args)
-	db, err := gorm.Open("postgres", args)
+	db, err := nimbus.NewPostgresStore(args, workerCount)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	return db
+}
+
+// migrate runs the migrate subcommand, which is one of status, up [version]
+// and down [version]. Up defaults to the latest version, down to the previous.
+func migrate(kind string, data string, args []string) {
+
+	if kind == "memory" {
+		log.Fatalln("Only the postgres and sqlite stores have a schema to migrate")
+	}
+	db := openDatabase(kind, data)
+	defer db.Close()
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	target := nimbus.LatestVersion()
+	if command == "down" {
+		target = current - 1
+	}
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil {
+			log.Fatalf("Invalid version '%s'\n", args[1])
+		}
+	}
+
+	switch command {
+	case "status":
+		for _, migration := range nimbus.Migrations {
+			state := "pending"
+			if migration.Version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%d %s: %s\n", migration.Version, migration.Name, state)
+		}
+		return
+	case "up":
+		if target < current {
+			log.Fatalf("Schema is at version %d, use down to go back to %d\n", current, target)
+		}
+	case "down":
+		if target > current {
+			log.Fatalf("Schema is at version %d, use up to go on to %d\n", current, target)
+		}
+	default:
+		log.Fatalf("Unknown migrate command '%s', use status, up or down\n", command)
+	}
+
+	if err = db.Migrate(target); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	log.Printf("Schema migrated from version %d to %d\n", current, target)
+}
+
+func newCache(kind string, size int, options nimbus.RedisOptions) nimbus.Cache {
+	if kind == "memory" {
+		log.Println("Caching feeds in memory")
+		return nimbus.NewMemoryCache(size)
+	}
+	switch {
+	case len(options.Cluster) > 0:
+		log.Printf("Connecting to redis cluster: %s\n", strings.Join(options.Cluster, ", "))
+	case len(options.Sentinels) > 0:
+		log.Printf("Connecting to redis master %s through sentinels: %s\n", options.Master, strings.Join(options.Sentinels, ", "))
+	default:
+		options.Server = fmt.Sprintf("%s:%s", os.Getenv("REDISHOST"), os.Getenv("REDISPORT"))
+		log.Printf("Connecting to redis: %s\n", options.Server)
+	}
+	redisCache, err := nimbus.NewRedisCache(options)
 	if err != nil {
 		log.Fatalf("%s\n", err)
 	}
+	if kind == "tiered" {
+		log.Println("Caching the hottest feeds in memory in front of redis")
+		return nimbus.NewTieredCache(redisCache, size)
+	}
+	return redisCache
+}
 
-	db.DB()
-	db.DB().SetMaxOpenConns(workerCount)
-	db.DB().SetMaxIdleConns(workerCount / 2)
-	db.SingularTable(true)
-	db.AutoMigrate(&nimbus.Feed{}, &nimbus.Item{}, &nimbus.Alias{})
-	return &db
+// remoteCache returns the Redis cache, alone or behind the cache in the
+// process, if feeds are cached in Redis.
+func remoteCache() (*nimbus.RedisCache, bool) {
+	if tieredCache, tiered := ca.(*nimbus.TieredCache); tiered {
+		return tieredCache.Remote(), true
+	}
+	redisCache, ok := ca.(*nimbus.RedisCache)
+	return redisCache, ok
+}
+
+// splitAddresses splits a comma separated list of addresses.
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
 }
 
 func fillCache() {
 
 	log.Println("Filling cache with feeds...")
-	var urls []string
-	db.Model(&nimbus.Feed{}).Pluck("url", &urls)
+	urls, err := st.FeedURLs()
+	if err != nil {
+		log.Printf("Failed to fill cache: %s\n", err)
+		return
+	}
 	log.Printf("There are %d feeds", len(urls))
 	for i, url := range urls {
 		setFeedInCache(url)
@@ -255,11 +1229,20 @@ func fillCache() {
 	log.Println("Done filling cache with feeds")
 
 	log.Println("Filling cache with aliases...")
-	var aliases []nimbus.Alias
-	db.Find(&aliases)
+	aliases, err := st.Aliases()
+	if err != nil {
+		log.Printf("Failed to fill cache: %s\n", err)
+		return
+	}
 	log.Printf("There are %d aliases", len(aliases))
 	for _, alias := range aliases {
-		ca.SetAlias(alias.Alias, alias.Original)
+		if alias.Unaliased {
+			continue
+		}
+		if err := ca.SetAlias(alias.Alias, alias.Original); err != nil {
+			log.Printf("Failed to fill cache: %s\n", err)
+			return
+		}
 	}
 	log.Println("Done filling cache with aliases")
 }
@@ -267,18 +1250,50 @@ func fillCache() {
 func main() {
 
 	flush := flag.Bool("flush", false, "enable this to flush cache")
+	distributed := flag.Bool("distributed", false, "enable this to share polling with other instances")
+	store := flag.String("store", "postgres", "where to keep feeds, postgres, sqlite or memory")
+	cache := flag.String("cache", "redis", "where to cache feeds, redis, memory or tiered, which is redis with the hottest feeds in memory")
+	cacheSize := flag.Int("cachesize", 10000, "how many feeds to cache in memory, or in front of redis when tiered, 0 for all")
+	redisPrefix := flag.String("redisprefix", "", "put this in front of every redis key, to share redis with others")
+	redisCluster := flag.String("rediscluster", "", "comma separated redis cluster nodes to discover the cluster from, instead of REDISHOST")
+	redisSentinels := flag.String("redissentinels", "", "comma separated redis sentinels to ask for the master, instead of REDISHOST")
+	redisMaster := flag.String("redismaster", "mymaster", "name of the master the redis sentinels monitor")
+	trusted := flag.String("proxies", "", "comma separated addresses or networks of proxies trusted to tell the client in X-Forwarded-For")
+	data := flag.String("data", ".", "directory of the sqlite database")
+	dormant := flag.Duration("dormant", 90*24*time.Hour, "stop polling feeds not requested for this long")
+	keep := flag.Int("keep", 0, "keep at least this many of the newest items of each feed, 0 keeps all")
+	maxAge := flag.Duration("maxage", 0, "keep at least the items published within this long, 0 keeps all")
 	flag.Parse()
 
 	// Increase logging precision
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	db = newDb()
-	defer db.Close()
+	if flag.Arg(0) == "migrate" {
+		migrate(*store, *data, flag.Args()[1:])
+		return
+	}
 
-	ca = nimbus.NewCache(fmt.Sprintf("%s:%s", os.Getenv("REDISHOST"), os.Getenv("REDISPORT")))
-	defer ca.Close()
+	// Names this instance among those sharing the cache
+	hostname, _ := os.Hostname()
+	instance := fmt.Sprintf("%s:%d:%d", strings.Replace(hostname, " ", "-", -1), os.Getpid(), time.Now().UnixNano())
+
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	var err error
+	if proxies, err = parseProxies(*trusted); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	st = newStore(*store, *data)
+	ca = newCache(*cache, *cacheSize, nimbus.RedisOptions{
+		Cluster:   splitAddresses(*redisCluster),
+		Sentinels: splitAddresses(*redisSentinels),
+		Master:    *redisMaster,
+		Prefix:    *redisPrefix,
+		Instance:  instance,
+	})
 	if *flush {
-		ca.Flush()
+		if err := ca.Flush(); err != nil {
+			log.Fatalf("Failed to flush cache: %s\n", err)
+		}
 		go fillCache()
 	}
 
@@ -288,24 +1303,106 @@ func main() {
 	}
 
 	// Start workers
-	for i := 0; i < workerCount; i++ {
-		go worker()
+	poll := func(url string, refresh bool) error {
+		_, err := pollFeed(url)
+		return err
 	}
+	if *distributed {
+		redisCache, ok := remoteCache()
+		if !ok {
+			log.Fatalln("Sharing polling with other instances requires the redis cache")
+		}
+		lease = nimbus.NewLease(redisCache, instance, leaseDuration)
+		shared = redisCache
+		poll = claimFeed
+	}
+	scheduler = nimbus.NewScheduler(workerCount, queueLimit, popularity.Weight, poll)
+	scheduler.Start()
 
 	// Start polling feeds
 	go pollFeeds()
+	ticker := time.NewTicker(pollFrequency * time.Second)
 	go func() {
-		for _ = range time.Tick(pollFrequency * time.Second) {
-			logJson(logData{"event": "queueLength", "length": len(queued)})
+		for _ = range ticker.C {
+			stats := scheduler.Stats()
+			logJson(logData{"event": "queueLength", "length": stats.Pending, "stats": stats})
+			sharePopularity()
+			markRequested()
+			sweepDormant(*dormant)
+			sweepPending()
+			resetRefreshes()
 			go pollFeeds()
 		}
 	}()
 
+	// Start pruning items
+	retention := nimbus.Retention{Keep: *keep, MaxAge: *maxAge, Floor: itemLimit}
+	pruner := time.NewTicker(pruneFrequency)
+	if retention.Enabled() {
+		go func() {
+			for _ = range pruner.C {
+				pruneItems(retention)
+			}
+		}()
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handler(w, r)
 	})
+	http.HandleFunc("/v2", statusHandler)
+	http.HandleFunc("/refresh", refreshHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/aliases", adminOnly(aliasesHandler))
+	http.HandleFunc("/aliases/unalias", adminOnly(unaliasHandler))
+	http.HandleFunc("/items/star", adminOnly(starHandler))
 
 	port := os.Getenv("PORT")
-	log.Printf("Listening on port %s\n", port)
-	http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Listening on port %s\n", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("%s\n", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down\n", <-signals)
+
+	shutdown(server, ticker, pruner)
+}
+
+// shutdown stops taking requests and polls, waits for in-flight polls to be
+// saved and leaves whatever was still queued for the next start. The store
+// and cache are only closed once nothing writes to them anymore.
+func shutdown(server *http.Server, ticker *time.Ticker, pruner *time.Ticker) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down http server: %s\n", err)
+	}
+
+	ticker.Stop()
+	pruner.Stop()
+	close(stopping)
+	deadline, _ := ctx.Deadline()
+	urls := scheduler.Stop(time.Until(deadline))
+	logJson(logData{"event": "shutdown", "unpolled": len(urls)})
+	if len(urls) > 0 {
+		st.Reschedule(urls, time.Now())
+	}
+
+	// Polls that outlasted the timeout are rescheduled, but still save
+	if active := scheduler.Stats().Active; active > 0 {
+		logJson(logData{"event": "shutdownWait", "active": active})
+	}
+	scheduler.Wait()
+	pruning.Lock()
+
+	if err := ca.Close(); err != nil {
+		log.Printf("Failed to close cache: %s\n", err)
+	}
+	st.Close()
 }
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bearfrieze/nimbus/nimbus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setUp replaces the cache, store and scheduler with ones living in memory.
+func setUp(cache nimbus.Cache) {
+	ca = cache
+	st = nimbus.NewMemoryStore()
+	degraded = nimbus.NewMemoryCache(degradedLimit)
+	scheduler = nimbus.NewScheduler(1, queueLimit, popularity.Weight, func(url string, refresh bool) error {
+		return nil
+	})
+}
+
+// request posts urls to the handler and decodes the response.
+func request(urls string, t *testing.T) map[string]json.RawMessage {
+	var response map[string]json.RawMessage
+	post(handler, urls, &response, t)
+	return response
+}
+
+func post(handler http.HandlerFunc, urls string, response interface{}, t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(urls)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 - Got %d", recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	ca.SetFeed("http://xkcd.com/rss.xml", &nimbus.Feed{Title: "xkcd.com"})
+	ca.MarkInvalid("http://example.com/invalid", &nimbus.Failure{Error: "Timeout", RetryAt: time.Now().Add(time.Minute)})
+
+	response := request(`["http://xkcd.com/rss.xml", "http://example.com/invalid", "http://example.com"]`, t)
+	if feed := string(response["http://xkcd.com/rss.xml"]); !strings.HasPrefix(feed, `{"title":"xkcd.com",`) {
+		t.Errorf("Expected the cached feed - Got %s", feed)
+	}
+	if marker := string(response["http://example.com/invalid"]); marker != "false" {
+		t.Errorf("Expected false - Got %s", marker)
+	}
+	if marker := string(response["http://example.com"]); marker != "true" {
+		t.Errorf("Expected true - Got %s", marker)
+	}
+	if pending := scheduler.Stats().Pending; pending != 1 {
+		t.Errorf("Expected 1 feed queued - Got %d", pending)
+	}
+	if marked, _ := ca.MarkPending("http://example.com", 60); marked {
+		t.Errorf("Expected the missing feed to be marked pending")
+	}
+}
+
+// unavailableCache fails like a cache that cannot be reached.
+type unavailableCache struct {
+	nimbus.MemoryCache
+}
+
+var errUnavailable = errors.New("Cache is unavailable")
+
+func (c *unavailableCache) MarkPending(url string, seconds int) (bool, error) {
+	return false, errUnavailable
+}
+
+func (c *unavailableCache) GetFeeds(urls []string) (map[string]nimbus.Value, []string, map[string]string, error) {
+	return nil, nil, nil, errUnavailable
+}
+
+func TestHandlerWithoutCache(t *testing.T) {
+
+	setUp(&unavailableCache{})
+	st.SaveFeed(&nimbus.Feed{Title: "xkcd.com", URL: "http://xkcd.com/rss.xml"}, nil)
+
+	response := request(`["http://xkcd.com/rss.xml", "http://example.com"]`, t)
+	if feed := string(response["http://xkcd.com/rss.xml"]); !strings.HasPrefix(feed, `{"title":"xkcd.com",`) {
+		t.Errorf("Expected the stored feed - Got %s", feed)
+	}
+	if marker := string(response["http://example.com"]); marker != "true" {
+		t.Errorf("Expected true - Got %s", marker)
+	}
+	if pending := scheduler.Stats().Pending; pending != 1 {
+		t.Errorf("Expected 1 feed queued - Got %d", pending)
+	}
+	if marked, _ := degraded.MarkPending("http://example.com", 60); marked {
+		t.Errorf("Expected the unknown feed to be marked pending without the cache")
+	}
+}
+
+func TestHandlerReadThrough(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	st.SaveFeed(&nimbus.Feed{Title: "xkcd.com", URL: "http://xkcd.com/rss.xml"}, nil)
+	st.CreateAlias(&nimbus.Alias{Alias: "http://xkcd.com/atom.xml", Original: "http://xkcd.com/rss.xml"})
+	st.SaveFeed(&nimbus.Feed{Title: "Dormant", URL: "http://example.com/dormant", Dormant: true}, nil)
+
+	response := request(`["http://xkcd.com/atom.xml", "http://example.com/dormant", "http://example.com"]`, t)
+	if feed := string(response["http://xkcd.com/atom.xml"]); !strings.HasPrefix(feed, `{"title":"xkcd.com",`) {
+		t.Errorf("Expected the stored feed - Got %s", feed)
+	}
+	if feed := string(response["http://example.com/dormant"]); !strings.HasPrefix(feed, `{"title":"Dormant",`) {
+		t.Errorf("Expected the stored feed - Got %s", feed)
+	}
+	if marker := string(response["http://example.com"]); marker != "true" {
+		t.Errorf("Expected true - Got %s", marker)
+	}
+	if pending := scheduler.Stats().Pending; pending != 2 {
+		t.Errorf("Expected the unknown and the dormant feed queued - Got %d", pending)
+	}
+
+	_, missing, _, _ := ca.GetFeeds([]string{"http://xkcd.com/rss.xml", "http://xkcd.com/atom.xml", "http://example.com/dormant"})
+	if len(missing) != 1 || missing[0] != "http://example.com/dormant" {
+		t.Errorf("Expected the stored feeds to be cached but the dormant one - Got %s missing", missing)
+	}
+	if revived, _ := st.Feed("http://example.com/dormant"); revived.Dormant {
+		t.Errorf("Expected the dormant feed to be revived")
+	}
+
+	// A feed cached by a poll in the meantime is not overwritten
+	ca.SetFeed("http://xkcd.com/rss.xml", &nimbus.Feed{Title: "Polled"})
+	stored, _ := st.Feed("http://xkcd.com/rss.xml")
+	cacheFeed("http://xkcd.com/rss.xml", stored)
+	cached, _, _, _ := ca.GetFeeds([]string{"http://xkcd.com/rss.xml"})
+	if feed, _ := cached["http://xkcd.com/rss.xml"].JSON(); !strings.HasPrefix(string(feed), `{"title":"Polled",`) {
+		t.Errorf("Expected the polled feed - Got %s", feed)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	ca.SetFeed("http://xkcd.com/rss.xml", &nimbus.Feed{Title: "xkcd.com", URL: "http://xkcd.com/rss.xml"})
+	ca.SetAlias("http://xkcd.com/atom.xml", "http://xkcd.com/rss.xml")
+	ca.MarkInvalid("http://example.com/gone", &nimbus.Failure{Error: "Feed is gone: 410 Gone", Gone: true, RetryAt: time.Now().Add(time.Minute)})
+
+	var response map[string]nimbus.Status
+	post(statusHandler, `["http://xkcd.com/atom.xml", "http://example.com/gone", "http://example.com"]`, &response, t)
+	if status := response["http://xkcd.com/atom.xml"]; status.Status != nimbus.StatusOK || status.Alias != "http://xkcd.com/rss.xml" || status.Feed == nil {
+		t.Errorf("Expected the feed through its alias - Got %+v", status)
+	}
+	if status := response["http://example.com/gone"]; status.Status != nimbus.StatusGone || status.Error != "Feed is gone: 410 Gone" {
+		t.Errorf("Expected the feed to be gone - Got %+v", status)
+	}
+	if status := response["http://example.com"]; status.Status != nimbus.StatusPending || status.Feed != nil {
+		t.Errorf("Expected the feed to be pending - Got %+v", status)
+	}
+}
+
+func TestAliasesHandler(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	admin := func(method string, target string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		mux := http.NewServeMux()
+		mux.HandleFunc("/aliases", adminOnly(aliasesHandler))
+		mux.HandleFunc("/aliases/unalias", adminOnly(unaliasHandler))
+		mux.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	recorder := httptest.NewRecorder()
+	adminOnly(aliasesHandler)(recorder, httptest.NewRequest("GET", "/aliases", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without the token - Got %d", recorder.Code)
+	}
+
+	st.SaveFeed(&nimbus.Feed{Title: "xkcd.com", URL: "http://xkcd.com/rss.xml"}, nil)
+	st.SaveFeed(&nimbus.Feed{Title: "Example", URL: "http://example.com"}, nil)
+	if code := admin("POST", "/aliases", `{"alias": "http://example.com", "original": "http://example.com/unknown"}`).Code; code != 404 {
+		t.Errorf("Expected status 404 for an unknown original - Got %d", code)
+	}
+	if _, err := st.Feed("http://example.com"); err != nil {
+		t.Errorf("Expected the feed to be kept - Got %s", err)
+	}
+	if code := admin("POST", "/aliases", `{"alias": "http://xkcd.com/atom.xml", "original": "http://xkcd.com/rss.xml"}`).Code; code != 201 {
+		t.Errorf("Expected status 201 - Got %d", code)
+	}
+	if code := admin("POST", "/aliases", `{"alias": "http://xkcd.com/rss.xml", "original": "http://xkcd.com/atom.xml"}`).Code; code != 409 {
+		t.Errorf("Expected status 409 for a cycle - Got %d", code)
+	}
+	var aliases []nimbus.Alias
+	json.Unmarshal(admin("GET", "/aliases", "").Body.Bytes(), &aliases)
+	if len(aliases) != 1 || aliases[0].Original != "http://xkcd.com/rss.xml" {
+		t.Errorf("Expected the alias to be listed - Got %+v", aliases)
+	}
+
+	if code := admin("POST", "/aliases/unalias?alias=http://xkcd.com/atom.xml", "").Code; code != 204 {
+		t.Errorf("Expected status 204 - Got %d", code)
+	}
+	if separate, _ := unaliased("http://xkcd.com/atom.xml"); !separate {
+		t.Errorf("Expected the feed to be kept apart")
+	}
+	if pending := scheduler.Stats().Pending; pending != 1 {
+		t.Errorf("Expected the unaliased feed queued - Got %d", pending)
+	}
+	if code := admin("DELETE", "/aliases?alias=http://xkcd.com/atom.xml", "").Code; code != 204 {
+		t.Errorf("Expected status 204 - Got %d", code)
+	}
+	if code := admin("DELETE", "/aliases?alias=http://xkcd.com/atom.xml", "").Code; code != 404 {
+		t.Errorf("Expected status 404 - Got %d", code)
+	}
+}
+
+func TestHandlerGzip(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	ca.SetFeed("http://xkcd.com/rss.xml", &nimbus.Feed{Title: "xkcd.com", URL: "http://xkcd.com/rss.xml"})
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`["http://xkcd.com/rss.xml", "http://example.com"]`))
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	handler(recorder, r)
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Expected a gzip response - Got '%s'", encoding)
+	}
+	zr, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %s", err)
+	}
+	var response map[string]json.RawMessage
+	if err := json.NewDecoder(zr).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if feed := string(response["http://xkcd.com/rss.xml"]); !strings.HasPrefix(feed, `{"title":"xkcd.com",`) {
+		t.Errorf("Expected the cached feed - Got %s", feed)
+	}
+
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	if acceptsGzip(r) {
+		t.Errorf("Expected gzip to be refused")
+	}
+}
+
+func TestRefreshLimits(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	resetRefreshes()
+	refresh := func(count int) int {
+		urls := make([]string, count)
+		for i := range urls {
+			urls[i] = fmt.Sprintf("http://example.com/%d", i)
+		}
+		body, _ := json.Marshal(urls)
+		recorder := httptest.NewRecorder()
+		refreshHandler(recorder, httptest.NewRequest("POST", "/refresh", strings.NewReader(string(body))))
+		return recorder.Code
+	}
+
+	if code := refresh(refreshLimit + 1); code != 400 {
+		t.Errorf("Expected 400 for too many feeds - Got %d", code)
+	}
+	for i := 0; i < refreshRate/refreshLimit; i++ {
+		if code := refresh(refreshLimit); code != 200 {
+			t.Errorf("Expected 200 - Got %d", code)
+		}
+	}
+	if code := refresh(1); code != 429 {
+		t.Errorf("Expected 429 beyond the rate - Got %d", code)
+	}
+	resetRefreshes()
+	if code := refresh(1); code != 200 {
+		t.Errorf("Expected 200 in the next round - Got %d", code)
+	}
+}
+
+// unaliasableStore refuses to create aliases.
+type unaliasableStore struct {
+	nimbus.Store
+}
+
+func (s *unaliasableStore) CreateAlias(alias *nimbus.Alias) error {
+	return nimbus.ErrAliasCycle
+}
+
+func TestPollDuplicateUnaliasable(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	st = &unaliasableStore{st}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Duplicate</title><link>http://example.com</link>`)
+		for guid, day := range []string{"Mon, 01", "Tue, 02", "Wed, 03"} {
+			fmt.Fprintf(w, `<item><title>Item %d</title><guid>%d</guid><link>http://example.com/%d</link><pubDate>%s Jan 2018 00:00:00 GMT</pubDate></item>`, guid, guid, guid, day)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer server.Close()
+	client = &http.Client{Timeout: time.Second}
+	original, _ := fetchFeed(server.URL)
+	original.URL = "http://example.com/rss"
+	st.SaveFeed(original, nil)
+
+	// The duplicate is saved as a feed of its own when it can't be aliased
+	if _, err := pollFeed(server.URL); err != nil {
+		t.Errorf("Expected the feed to be saved - Got %s", err)
+	}
+	if _, err := st.Feed(server.URL); err != nil {
+		t.Errorf("Expected the feed to be stored - Got %s", err)
+	}
+}
+
+func TestReviveFailed(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+	client = &http.Client{Timeout: time.Second}
+	st.SaveFeed(&nimbus.Feed{Title: "Dormant", URL: server.URL, Dormant: true}, nil)
+
+	// The feed stays revived and is polled as usual when its revival fails
+	request(fmt.Sprintf(`[%q]`, server.URL), t)
+	if _, err := pollFeed(server.URL); err == nil {
+		t.Fatalf("Expected the poll to fail")
+	}
+	feed, _ := st.Feed(server.URL)
+	if feed.Dormant {
+		t.Errorf("Expected the feed to be revived")
+	}
+	due, _ := st.DueFeeds(feed.NextPollAt.Add(time.Second))
+	if len(due) != 1 {
+		t.Errorf("Expected the feed to be due once it is retried - Got %d due", len(due))
+	}
+	if _, missing, _, _ := ca.GetFeeds([]string{server.URL}); len(missing) > 0 {
+		t.Errorf("Expected the feed to be cached")
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+
+	var err error
+	if proxies, err = parseProxies("10.0.0.1, 192.168.0.0/16"); err != nil {
+		t.Fatalf("Failed to parse proxies: %s", err)
+	}
+	defer func() { proxies = nil }()
+	address := func(remote string, forwarded ...string) string {
+		r := httptest.NewRequest("POST", "/refresh", nil)
+		r.RemoteAddr = remote
+		for _, header := range forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		return clientAddress(r)
+	}
+
+	if client := address("203.0.113.7:1234", "198.51.100.1"); client != "203.0.113.7" {
+		t.Errorf("Expected untrusted clients to be told by address - Got %s", client)
+	}
+	if client := address("10.0.0.1:1234", "198.51.100.1, 192.168.1.2"); client != "198.51.100.1" {
+		t.Errorf("Expected the client behind the proxies - Got %s", client)
+	}
+	if client := address("10.0.0.1:1234", "6.6.6.6", "198.51.100.1"); client != "198.51.100.1" {
+		t.Errorf("Expected the address the proxies were given - Got %s", client)
+	}
+	if client := address("10.0.0.1:1234"); client != "10.0.0.1" {
+		t.Errorf("Expected the proxy without a forwarded address - Got %s", client)
+	}
+	if _, err := parseProxies("10.0.0.300"); err == nil {
+		t.Errorf("Expected an invalid proxy to be refused")
+	}
+}
+
+func TestPollFeed(t *testing.T) {
+
+	setUp(nimbus.NewMemoryCache(0))
+	items := []string{"1", "2"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Polled</title><link>http://example.com</link>`)
+		for _, guid := range items {
+			fmt.Fprintf(w, `<item><title>Item %s</title><guid>%s</guid><link>http://example.com/%s</link><pubDate>0%s Jan 2018 00:00:00 GMT</pubDate></item>`, guid, guid, guid, guid)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer server.Close()
+	client = &http.Client{Timeout: time.Second}
+
+	// New feeds are stored without history
+	if _, err := pollFeed(server.URL); err != nil {
+		t.Fatalf("Expected the feed to be polled - Got %s", err)
+	}
+	feed, err := st.Feed(server.URL)
+	if err != nil || feed.Title != "Polled" || feed.Activity != "" {
+		t.Fatalf("Expected the feed stored without activity - Got %v, %v", feed, err)
+	}
+
+	// Later polls learn from the items they find
+	pollFeed(server.URL)
+	time.Sleep(10 * time.Millisecond)
+	items = append(items, "3")
+	before := time.Now()
+	pollFeed(server.URL)
+	feed, _ = st.Feed(server.URL)
+	if activity := nimbus.ParseActivity(feed.Activity); activity.Rate <= 0 {
+		t.Errorf("Expected a rate of arrivals - Got %v", activity)
+	}
+	if !feed.NextPollAt.After(before) || feed.NextPollAt.After(time.Now().Add(feed.Timeout())) {
+		t.Errorf("Expected the next poll within %s - Got %s", feed.Timeout(), feed.NextPollAt)
+	}
+	stored, _ := st.Items(feed.ID, itemLimit)
+	if len(stored) != 3 {
+		t.Errorf("Expected 3 items - Got %d", len(stored))
+	}
+
+	response := request(fmt.Sprintf(`[%q]`, server.URL), t)
+	if cached := string(response[server.URL]); !strings.HasPrefix(cached, `{"title":"Polled",`) {
+		t.Errorf("Expected the polled feed to be cached - Got %s", cached)
+	}
+}
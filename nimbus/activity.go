@@ -0,0 +1,117 @@
+package nimbus
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+const (
+	rateWindow      = 7 * 24 * time.Hour  // Horizon of the moving arrival rate
+	patternWindow   = 28 * 24 * time.Hour // Horizon of the hour and weekday patterns
+	patternPrior    = 1.0                 // Pseudo count smoothing sparse patterns
+	minObservations = 3                   // Polls needed before history is trusted
+	pollTarget      = 0.5                 // Expected new items at which to poll again
+	scheduleStep    = 10 * time.Minute
+)
+
+// Activity is learned from our own polls of a feed rather than from the
+// published dates of its items, which may be missing, wrong or reposted.
+type Activity struct {
+	Rate     float64     `json:"r"` // New items per hour
+	Hours    [24]float64 `json:"h"` // Decayed new items by hour of day (UTC)
+	Weekdays [7]float64  `json:"w"` // Decayed new items by weekday (UTC)
+	Polls    int         `json:"n"`
+	PolledAt time.Time   `json:"t"`
+}
+
+func ParseActivity(s string) Activity {
+	var a Activity
+	if s != "" {
+		json.Unmarshal([]byte(s), &a)
+	}
+	return a
+}
+
+func (a Activity) String() string {
+	marshalled, _ := json.Marshal(a)
+	return string(marshalled)
+}
+
+// Observe records that a poll at the given time found a number of new items.
+func (a *Activity) Observe(found int, at time.Time) {
+
+	if a.PolledAt.IsZero() || !at.After(a.PolledAt) {
+		a.PolledAt = at
+		return
+	}
+
+	hours := at.Sub(a.PolledAt).Hours()
+
+	// Time weighted moving average, unbiased while there are few polls
+	weight := math.Max(1-math.Exp(-hours/rateWindow.Hours()), 1/float64(a.Polls+1))
+	a.Rate += weight * (float64(found)/hours - a.Rate)
+
+	decay := math.Exp(-hours / patternWindow.Hours())
+	for i := range a.Hours {
+		a.Hours[i] *= decay
+	}
+	for i := range a.Weekdays {
+		a.Weekdays[i] *= decay
+	}
+
+	// Spread the new items evenly across the hours since the last poll
+	for t := a.PolledAt; found > 0 && t.Before(at); {
+		end := t.Truncate(time.Hour).Add(time.Hour)
+		if end.After(at) {
+			end = at
+		}
+		share := float64(found) * end.Sub(t).Hours() / hours
+		a.Hours[t.UTC().Hour()] += share
+		a.Weekdays[t.UTC().Weekday()] += share
+		t = end
+	}
+
+	a.Polls++
+	a.PolledAt = at
+}
+
+// Timeout is the time until enough new items are expected to warrant a poll,
+// or the fallback while there is too little history to go by.
+func (a Activity) Timeout(now time.Time, fallback time.Duration) time.Duration {
+
+	if a.Polls < minObservations {
+		return fallback
+	}
+	if a.Rate <= 0 {
+		return maxTimeout
+	}
+
+	var expected float64
+	for d := scheduleStep; d < maxTimeout; d += scheduleStep {
+		expected += a.Rate * a.factor(now.Add(d)) * scheduleStep.Hours()
+		if expected >= pollTarget {
+			if d < minTimeout {
+				return minTimeout
+			}
+			return d
+		}
+	}
+
+	return maxTimeout
+}
+
+// factor is how much busier than average the feed is at the given time.
+func (a Activity) factor(t time.Time) float64 {
+	t = t.UTC()
+	return share(a.Hours[:], t.Hour()) * share(a.Weekdays[:], int(t.Weekday()))
+}
+
+func share(buckets []float64, i int) float64 {
+	var total float64
+	for _, b := range buckets {
+		total += b
+	}
+	n := float64(len(buckets))
+	return (buckets[i] + patternPrior) / (total + n*patternPrior) * n
+}
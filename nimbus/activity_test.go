@@ -0,0 +1,54 @@
+package nimbus
+
+import (
+	"testing"
+	"time"
+)
+
+var monday = time.Date(2015, 7, 6, 0, 0, 0, 0, time.UTC)
+
+func TestActivityFallback(t *testing.T) {
+	var a Activity
+	a.Observe(10, monday)
+	a.Observe(10, monday.Add(time.Hour))
+	expect(a.Timeout(monday.Add(time.Hour), 3*time.Hour), 3*time.Hour, t)
+}
+
+func TestActivityQuiet(t *testing.T) {
+	var a Activity
+	for i := 0; i <= 10; i++ {
+		a.Observe(0, monday.Add(time.Duration(i)*maxTimeout))
+	}
+	expect(a.Timeout(monday, minTimeout), maxTimeout, t)
+}
+
+func TestActivityBusyHours(t *testing.T) {
+
+	// Four weeks of a feed publishing four items an hour during office hours
+	var a Activity
+	for now := monday; now.Before(monday.Add(patternWindow)); now = now.Add(time.Hour) {
+		found := 0
+		if h := now.Add(-time.Hour).Hour(); h >= 9 && h < 17 {
+			found = 4
+		}
+		a.Observe(found, now)
+	}
+
+	busy := a.Timeout(monday.Add(10*time.Hour), maxTimeout)
+	quiet := a.Timeout(monday.Add(20*time.Hour), maxTimeout)
+	expect(busy, minTimeout, t)
+	if quiet < 10*time.Hour {
+		t.Errorf("Expected a long timeout outside of busy hours - Got %v", quiet)
+	}
+}
+
+func TestActivityEncoding(t *testing.T) {
+	var a Activity
+	a.Observe(0, monday)
+	a.Observe(3, monday.Add(time.Hour))
+	b := ParseActivity(a.String())
+	expect(b.Rate, a.Rate, t)
+	expect(b.Polls, a.Polls, t)
+	expect(b.PolledAt.Equal(a.PolledAt), true, t)
+	expect(ParseActivity("").Polls, 0, t)
+}
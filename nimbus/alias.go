@@ -1,10 +1,49 @@
 package nimbus
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
+// ErrAliasCycle is returned for aliases that lead back to where they started.
+var ErrAliasCycle = errors.New("Alias cycle")
+
+// Alias points the url of a feed at the feed it duplicates. Unaliased aliases
+// were undone by hand, and keep the feed from being aliased again.
 type Alias struct {
-	ID        int
-	Alias     string `sql:"unique_index"`
-	Original  string `sql:"index"`
-	CreatedAt time.Time
+	ID        int       `json:"-"`
+	Alias     string    `json:"alias" sql:"unique_index"`
+	Original  string    `json:"original" sql:"index"`
+	Unaliased bool      `json:"unaliased"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// resolveAlias follows aliases from url to the original at the end of the
+// chain, looking each one up with lookup, and returns the aliases passed on
+// the way. ErrNotFound is returned if url is not an alias.
+func resolveAlias(url string, lookup func(alias string) (string, error)) (string, []string, error) {
+
+	seen := map[string]bool{url: true}
+	var hops []string
+	original := url
+	for {
+		next, err := lookup(original)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if seen[next] {
+			return "", nil, ErrAliasCycle
+		}
+		seen[next] = true
+		hops = append(hops, original)
+		original = next
+	}
+
+	if len(hops) == 0 {
+		return "", nil, ErrNotFound
+	}
+	return original, hops, nil
 }
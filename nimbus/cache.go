@@ -2,117 +2,665 @@ package nimbus
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"log"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
-type Cache struct {
-	pool redis.Pool
+const (
+	pendingMarker = "true"
+	invalidMarker = "false"
+)
+
+// Cache holds the JSON of feeds ready to be served along with aliases, and
+// marks feeds that are pending with "true" and invalid feeds with "false".
+// Errors are those of reaching the cache, a missing feed is not one.
+type Cache interface {
+	Flush() error
+	Close() error
+	// MarkPending marks a feed as pending for some seconds unless it is
+	// already cached or marked, returning whether it did.
+	MarkPending(url string, seconds int) (bool, error)
+	// MarkInvalid marks a feed as invalid until it is retried, keeping the
+	// failure for GetFailures.
+	MarkInvalid(url string, failure *Failure) error
+	// Pending returns the feeds this instance marked pending before the given
+	// time that still are, so that those whose poll was lost can be polled
+	// again. Feeds marked by other instances are theirs to poll.
+	Pending(before time.Time) ([]string, error)
+	Delete(url string) error
+	// SetFeed caches the JSON of a feed compressed.
+	SetFeed(url string, feed *Feed) error
+	// AddFeed caches a feed like SetFeed unless the url already has a value,
+	// which may be that of a newer poll.
+	AddFeed(url string, feed *Feed) error
+	SetAlias(alias string, original string) error
+	DeleteAlias(alias string) error
+	// GetFeeds returns the cached value of every url, "true" for the missing,
+	// following chains of aliases to the feed at their end, and the url of
+	// that feed by url. Urls in a cycle of aliases are looked up as they are.
+	GetFeeds(urls []string) (map[string]Value, []string, map[string]string, error)
+	// GetFailures returns the failures of the urls marked invalid, by url.
+	GetFailures(urls []string) (map[string]*Failure, error)
+	// TakeRequested returns the feeds requested since it was last called.
+	TakeRequested() ([]string, error)
 }
 
-func NewCache(server string) *Cache {
+// encodeFeed returns the value a feed is cached as. The value is read back
+// and refused unless it is valid JSON, as responses splice it in unread.
+func encodeFeed(url string, feed *Feed) (string, error) {
+	marshalled, err := json.Marshal(feed)
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal feed '%s': %s", url, err)
+	}
+	compressed, err := compressValue(marshalled)
+	if err != nil {
+		return "", fmt.Errorf("Unable to compress feed '%s': %s", url, err)
+	}
+	data, err := compressed.JSON()
+	var valid json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(data, &valid)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read back feed '%s': %s", url, err)
+	}
+	return string(compressed), nil
+}
 
-	// http://godoc.org/github.com/garyburd/redigo/redis#Pool
-	pool := redis.Pool{
-		MaxIdle:     20,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+// failureKey is where the failure of an invalid feed is kept.
+func failureKey(url string) string {
+	return "failure:" + url
+}
+
+// valueCache sets values along with when they expire, which caches build
+// markers from. Setting a value and its expiry at once leaves no marker that
+// never expires behind when something fails in between.
+type valueCache interface {
+	SetEx(url string, value string, seconds int) error
+}
+
+// retrySeconds returns for how long a failed feed is marked invalid, at least
+// a second as Redis refuses to set values expiring right away.
+func retrySeconds(failure *Failure) int {
+	seconds := int(time.Until(failure.RetryAt) / time.Second)
+	if seconds < 1 {
+		return 1
 	}
+	return seconds
+}
+
+// markInvalid marks a feed as invalid and keeps its failure, both expiring
+// once the feed is to be retried.
+func markInvalid(c valueCache, url string, failure *Failure) error {
 
-	return &Cache{pool: pool}
+	marshalled, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	seconds := retrySeconds(failure)
+	if err = c.SetEx(url, invalidMarker, seconds); err == nil {
+		err = c.SetEx(failureKey(url), string(marshalled), seconds)
+	}
+	return err
 }
 
-func (c Cache) Flush() {
-	conn := c.pool.Get()
-	defer conn.Close()
+// RedisOptions tells NewRedisCache how to reach Redis and where to keep keys.
+type RedisOptions struct {
+	Server    string   // Address of a single Redis
+	Cluster   []string // Addresses of nodes to discover a Redis Cluster from
+	Sentinels []string // Addresses of sentinels to ask for the master
+	Master    string   // Name of the master the sentinels monitor
+	Prefix    string   // Put in front of every key, to share Redis with others
+	Instance  string   // Names this instance in what it records, without spaces
+}
+
+// RedisCache keeps every key of a feed under its url in braces, which Redis
+// Cluster hashes alone, so that they land on the same node:
+//
+//	<prefix>feed:{<url>}          JSON of the feed, or a marker
+//	<prefix>failure:{<url>}       failure of an invalid feed
+//	<prefix>alias:{<url>}         url of the feed the url is an alias of
+//	<prefix>lease:{<url>}         instance polling the feed
+//	<prefix>refreshes:{<client>}  feeds a client refreshed this round
+//	<prefix>requested             set of feeds requested lately
+//	<prefix>popularity            decayed count of the clients requesting each feed
+//	<prefix>decayed               when the popularity was last decayed
+//	<prefix>pending               "<instance> <url>" of feeds marked pending, by when
+type RedisCache struct {
+	backend  redisBackend
+	prefix   string
+	instance string
+}
+
+func NewRedisCache(options RedisOptions) (*RedisCache, error) {
+
+	if strings.ContainsAny(options.Prefix, "{}") {
+		return nil, fmt.Errorf("Redis key prefix '%s' can't contain braces", options.Prefix)
+	}
+	if strings.Contains(options.Instance, " ") {
+		return nil, fmt.Errorf("Instance name '%s' can't contain spaces", options.Instance)
+	}
+
+	var backend redisBackend
+	switch {
+	case len(options.Cluster) > 0:
+		backend = newClusterRedis(options.Cluster)
+	case len(options.Sentinels) > 0:
+		if options.Master == "" {
+			return nil, fmt.Errorf("Redis sentinels need the name of the master")
+		}
+		backend = newSentinelRedis(options.Sentinels, options.Master)
+	default:
+		backend = newSingleRedis(options.Server)
+	}
+
+	return &RedisCache{backend: backend, prefix: options.Prefix, instance: options.Instance}, nil
+}
+
+func (c *RedisCache) feedKey(url string) string {
+	return c.prefix + "feed:{" + url + "}"
+}
+
+func (c *RedisCache) failureKey(url string) string {
+	return c.prefix + "failure:{" + url + "}"
+}
+
+func (c *RedisCache) aliasKey(url string) string {
+	return c.prefix + "alias:{" + url + "}"
+}
+
+func (c *RedisCache) leaseKey(url string) string {
+	return c.prefix + "lease:{" + url + "}"
+}
+
+func (c *RedisCache) refreshesKey(client string) string {
+	return c.prefix + "refreshes:{" + client + "}"
+}
+
+func (c *RedisCache) requestedKey() string {
+	return c.prefix + "requested"
+}
+
+func (c *RedisCache) popularityKey() string {
+	return c.prefix + "popularity"
+}
+
+func (c *RedisCache) decayedKey() string {
+	return c.prefix + "decayed"
+}
+
+func (c *RedisCache) pendingKey() string {
+	return c.prefix + "pending"
+}
+
+// pendingMember records which instance marked a feed pending.
+func (c *RedisCache) pendingMember(url string) string {
+	return c.instance + " " + url
+}
+
+// parsePendingMember returns the instance that marked a feed pending, and the
+// url of the feed.
+func parsePendingMember(member string) (string, string) {
+	if i := strings.IndexByte(member, ' '); i >= 0 {
+		return member[:i], member[i+1:]
+	}
+	return "", member
+}
+
+// do runs a single command.
+func (c *RedisCache) do(name string, args ...interface{}) (interface{}, error) {
+	replies, err := c.backend.pipeline([]redisCommand{newCommand(name, args...)})
+	if err != nil {
+		return nil, err
+	}
+	if err, isError := replies[0].(redis.Error); isError {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// replyError returns the first error reply of a pipeline, if any.
+func replyError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, isError := reply.(redis.Error); isError {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush empties every master, or only deletes the keys behind the prefix
+// if there is one, as others may share Redis.
+func (c *RedisCache) Flush() error {
+	pools, err := c.backend.masters()
+	if err != nil {
+		return err
+	}
 	log.Println("Flushing cache...")
-	conn.Do("FLUSHDB")
+	for _, pool := range pools {
+		conn := pool.Get()
+		if c.prefix == "" {
+			_, err = conn.Do("FLUSHDB")
+		} else {
+			err = c.deletePrefixed(conn)
+		}
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
 	log.Println("Done flushing cache")
+	return nil
 }
 
-func (c Cache) Close() {
-	c.pool.Close()
+// deletePrefixed deletes the keys behind the prefix from a node one at a
+// time, as those in a batch may not share a slot.
+func (c *RedisCache) deletePrefixed(conn redis.Conn) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		if len(reply) != 2 {
+			return fmt.Errorf("Unexpected reply to SCAN")
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		commands := make([]redisCommand, len(keys))
+		for i, key := range keys {
+			commands[i] = newCommand("DEL", key)
+		}
+		if _, err := runPipeline(conn, commands); err != nil {
+			return err
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil || cursor == "0" {
+			return err
+		}
+	}
 }
 
-func (c Cache) Set(url string, value string) {
-	conn := c.pool.Get()
-	defer conn.Close()
-	_, err := conn.Do("SET", url, value)
+func (c *RedisCache) Close() error {
+	return c.backend.close()
+}
+
+func (c *RedisCache) Set(url string, value string) error {
+	_, err := c.do("SET", c.feedKey(url), value)
+	return err
+}
+
+// SetEx sets the value of a url expiring after some seconds.
+func (c *RedisCache) SetEx(url string, value string, seconds int) error {
+	_, err := c.do("SET", c.feedKey(url), value, "EX", seconds)
+	return err
+}
+
+// AddEx sets the value of a url expiring after some seconds unless it has
+// one, returning whether it did.
+func (c *RedisCache) AddEx(url string, value string, seconds int) (bool, error) {
+	reply, err := redis.String(c.do("SET", c.feedKey(url), value, "NX", "EX", seconds))
+	if err == redis.ErrNil {
+		return false, nil
+	}
 	if err != nil {
-		log.Printf("Failed to set feed '%s': %s", url, err)
+		return false, err
 	}
+	return reply == "OK", nil
 }
 
-func (c Cache) Expire(url string, seconds int) {
-	conn := c.pool.Get()
-	defer conn.Close()
-	_, err := conn.Do("EXPIRE", url, seconds)
+// MarkPending also records when and by which instance the feed was marked,
+// for Pending. Should that fail the marker still expires by itself.
+func (c *RedisCache) MarkPending(url string, seconds int) (bool, error) {
+	added, err := c.AddEx(url, pendingMarker, seconds)
+	if err != nil || !added {
+		return false, err
+	}
+	if _, err := c.do("ZADD", c.pendingKey(), time.Now().Unix(), c.pendingMember(url)); err != nil {
+		log.Printf("Failed to record pending feed %s: %s", url, err)
+	}
+	return true, nil
+}
+
+// Pending forgets the feeds recorded as pending that no longer are, whichever
+// instance marked them, as an instance that went down can't.
+func (c *RedisCache) Pending(before time.Time) ([]string, error) {
+
+	members, err := redis.Strings(c.do("ZRANGEBYSCORE", c.pendingKey(), "-inf", before.Unix()))
+	if err != nil || len(members) == 0 {
+		return []string{}, err
+	}
+
+	commands := make([]redisCommand, len(members))
+	for i, member := range members {
+		_, url := parsePendingMember(member)
+		commands[i] = newCommand("GET", c.feedKey(url))
+	}
+	replies, err := c.backend.pipeline(commands)
 	if err != nil {
-		log.Printf("Failed to expire feed '%s': %s", url, err)
+		return nil, err
+	}
+
+	pending := make([]string, 0)
+	done := redis.Args{c.pendingKey()}
+	for i, member := range members {
+		value, err := redis.String(replies[i], nil)
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		instance, url := parsePendingMember(member)
+		switch {
+		case value != pendingMarker:
+			done = done.Add(member)
+		case instance == c.instance:
+			pending = append(pending, url)
+		}
 	}
+	if len(done) > 1 {
+		if _, err := c.do("ZREM", done...); err != nil {
+			log.Printf("Failed to forget pending feeds: %s", err)
+		}
+	}
+	return pending, nil
 }
 
-func (c Cache) SetFeed(url string, feed *Feed) {
-	marshalled, err := json.Marshal(feed)
+func (c *RedisCache) MarkInvalid(url string, failure *Failure) error {
+
+	marshalled, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	seconds := retrySeconds(failure)
+	replies, err := c.backend.pipeline([]redisCommand{
+		newCommand("SET", c.feedKey(url), invalidMarker, "EX", seconds),
+		newCommand("SET", c.failureKey(url), string(marshalled), "EX", seconds),
+	})
 	if err != nil {
-		log.Printf("Unable to marshal feed '%s': %s", url, err)
-		return
+		return err
 	}
-	c.Set(url, string(marshalled))
+	return replyError(replies)
 }
 
-func (c Cache) SetAlias(alias string, original string) {
-	conn := c.pool.Get()
-	defer conn.Close()
-	_, err := conn.Do("HSET", "aliases", alias, original)
+// GetFailures gets failures a key at a time in a pipeline, as the keys of
+// different feeds may be on different nodes.
+func (c *RedisCache) GetFailures(urls []string) (map[string]*Failure, error) {
+
+	failures := make(map[string]*Failure)
+	if len(urls) == 0 {
+		return failures, nil
+	}
+
+	commands := make([]redisCommand, len(urls))
+	for i, url := range urls {
+		commands[i] = newCommand("GET", c.failureKey(url))
+	}
+	replies, err := c.backend.pipeline(commands)
 	if err != nil {
-		log.Printf("Failed to set alias '%s' of '%s': %s", alias, original, err)
+		return nil, err
 	}
+	for i, reply := range replies {
+		value, err := redis.Bytes(reply, nil)
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var failure Failure
+		if json.Unmarshal(value, &failure) == nil {
+			failures[urls[i]] = &failure
+		}
+	}
+	return failures, nil
 }
 
-func (c Cache) GetFeeds(urls []string) (map[string]*json.RawMessage, []string) {
+func (c *RedisCache) SetFeed(url string, feed *Feed) error {
+	value, err := encodeFeed(url, feed)
+	if err != nil {
+		return err
+	}
+	return c.Set(url, value)
+}
 
-	conn := c.pool.Get()
-	defer conn.Close()
+func (c *RedisCache) AddFeed(url string, feed *Feed) error {
+	value, err := encodeFeed(url, feed)
+	if err != nil {
+		return err
+	}
+	_, err = c.do("SET", c.feedKey(url), value, "NX")
+	return err
+}
 
-	response := make(map[string]*json.RawMessage)
+func (c *RedisCache) SetAlias(alias string, original string) error {
+	_, err := c.do("SET", c.aliasKey(alias), original)
+	return err
+}
 
+func (c *RedisCache) DeleteAlias(alias string) error {
+	_, err := c.do("DEL", c.aliasKey(alias))
+	return err
+}
+
+// resolveAliases follows the aliases of the urls a level per round trip,
+// returning the key each url is cached under, and what each url looked up on
+// the way is an alias of, "" if nothing. Urls more than a level from their
+// original are pointed straight at it.
+func (c *RedisCache) resolveAliases(urls []string) (map[string]string, map[string]string, error) {
+
+	hops := make(map[string]string)
+	keys := make(map[string]string, len(urls))
+	seen := make(map[string]map[string]bool)
+	pending := make([]string, 0, len(urls))
 	for _, url := range urls {
-		conn.Send("HGET", "aliases", url)
+		if _, exists := keys[url]; !exists {
+			keys[url] = url
+			pending = append(pending, url)
+		}
 	}
-	conn.Flush()
 
-	for i, _ := range urls {
-		alias, _ := redis.String(conn.Receive())
-		if alias != "" {
-			conn.Send("GET", alias)
-			continue
+	for len(pending) > 0 {
+		commands := make([]redisCommand, len(pending))
+		for i, url := range pending {
+			commands[i] = newCommand("GET", c.aliasKey(keys[url]))
+		}
+		replies, err := c.backend.pipeline(commands)
+		if err != nil {
+			return nil, nil, err
 		}
-		conn.Send("GET", urls[i])
+		next := pending[:0]
+		for i, url := range pending {
+			original, err := redis.String(replies[i], nil)
+			if err != nil && err != redis.ErrNil {
+				return nil, nil, err
+			}
+			hops[keys[url]] = original
+			if original == "" {
+				continue
+			}
+			if seen[url] == nil {
+				seen[url] = map[string]bool{url: true}
+			}
+			if seen[url][original] {
+				log.Printf("Aliases of %s form a cycle", url)
+				keys[url] = url
+				delete(seen, url)
+				continue
+			}
+			seen[url][original] = true
+			keys[url] = original
+			next = append(next, url)
+		}
+		pending = next
+	}
+
+	var compressed []redisCommand
+	for url, hops := range seen {
+		if len(hops) > 2 {
+			compressed = append(compressed, newCommand("SET", c.aliasKey(url), keys[url]))
+		}
+	}
+	if len(compressed) > 0 {
+		if _, err := c.backend.pipeline(compressed); err != nil {
+			log.Printf("Failed to compress aliases: %s", err)
+		}
+	}
+
+	return keys, hops, nil
+}
+
+func (c *RedisCache) GetFeeds(urls []string) (map[string]Value, []string, map[string]string, error) {
+	response, missing, keys, _, err := c.getFeeds(urls)
+	return response, missing, keys, err
+}
+
+// getFeeds gets feeds like GetFeeds, also returning the keys and aliases
+// found by resolveAliases.
+func (c *RedisCache) getFeeds(urls []string) (map[string]Value, []string, map[string]string, map[string]string, error) {
+
+	response := make(map[string]Value)
+
+	keys, hops, err := c.resolveAliases(urls)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Remember which feeds were requested, under their original urls
+	commands := make([]redisCommand, len(urls), len(urls)+1)
+	requested := redis.Args{c.requestedKey()}
+	for i, url := range urls {
+		commands[i] = newCommand("GET", c.feedKey(keys[url]))
+		requested = requested.Add(keys[url])
+	}
+	if len(urls) > 0 {
+		commands = append(commands, newCommand("SADD", requested...))
+	}
+	replies, err := c.backend.pipeline(commands)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-	conn.Flush()
 
 	missing := make([]string, 0)
-	for _, url := range urls {
-		value, err := redis.String(conn.Receive())
-		if err != nil {
-			value = "true"
+	for i, url := range urls {
+		value, err := redis.Bytes(replies[i], nil)
+		if err == redis.ErrNil {
+			value = []byte(pendingMarker)
 			missing = append(missing, url)
+		} else if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		response[url] = Value(value)
+	}
+	if len(urls) > 0 {
+		if err, isError := replies[len(urls)].(redis.Error); isError {
+			log.Printf("Failed to record requested feeds: %s", err)
 		}
-		rm := json.RawMessage(value)
-		response[url] = &rm
 	}
 
-	return response, missing
+	return response, missing, keys, hops, nil
+}
+
+func (c *RedisCache) TakeRequested() ([]string, error) {
+	conn := c.backend.get(c.requestedKey())
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SMEMBERS", c.requestedKey())
+	conn.Send("DEL", c.requestedKey())
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	return redis.Strings(replies[0], nil)
+}
+
+// CountRefreshes counts the feeds a client refreshes through any instance in
+// a round of some seconds, telling if they are within the limit. Feeds beyond
+// the limit are not counted.
+func (c *RedisCache) CountRefreshes(client string, feeds int, limit int, seconds int) (bool, error) {
+	key := c.refreshesKey(client)
+	replies, err := c.backend.pipeline([]redisCommand{
+		newCommand("SET", key, 0, "EX", seconds, "NX"),
+		newCommand("INCRBY", key, feeds),
+	})
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		return false, err
+	}
+	count, err := redis.Int(replies[1], nil)
+	if err != nil {
+		return false, err
+	}
+	if count <= limit {
+		return true, nil
+	}
+	if _, err := c.do("DECRBY", key, feeds); err != nil {
+		log.Printf("Failed to uncount refreshes of %s: %s", client, err)
+	}
+	return false, nil
+}
+
+// SharePopularity adds the hits an instance counted to those of every
+// instance, and returns the scores of the limit most popular feeds. Scores are
+// decayed by halfLife for the time since any instance last decayed them, and
+// forgotten once they have all but decayed away.
+func (c *RedisCache) SharePopularity(hits map[string]float64, halfLife time.Duration, limit int) (map[string]float64, error) {
+
+	now := time.Now()
+	commands := make([]redisCommand, 0, len(hits)+1)
+	for url, count := range hits {
+		commands = append(commands, newCommand("ZINCRBY", c.popularityKey(), count, url))
+	}
+	commands = append(commands, newCommand("GETSET", c.decayedKey(), now.UnixNano()))
+	replies, err := c.backend.pipeline(commands)
+	if err != nil {
+		return nil, err
+	}
+	if err := replyError(replies); err != nil {
+		return nil, err
+	}
+
+	decayed, err := redis.Int64(replies[len(replies)-1], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if err == nil {
+		elapsed := now.Sub(time.Unix(0, decayed))
+		replies, err = c.backend.pipeline([]redisCommand{
+			newCommand("ZUNIONSTORE", c.popularityKey(), 1, c.popularityKey(), "WEIGHTS", math.Exp2(-elapsed.Hours()/halfLife.Hours())),
+			newCommand("ZREMRANGEBYSCORE", c.popularityKey(), "-inf", popularityFloor),
+			newCommand("ZREMRANGEBYRANK", c.popularityKey(), 0, -limit-1),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := replyError(replies); err != nil {
+			return nil, err
+		}
+	}
+
+	ranked, err := redis.Strings(c.do("ZREVRANGE", c.popularityKey(), 0, limit-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]float64, len(ranked)/2)
+	for i := 0; i+1 < len(ranked); i += 2 {
+		score, err := strconv.ParseFloat(ranked[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		scores[ranked[i]] = score
+	}
+	return scores, nil
+}
+
+func (c *RedisCache) Delete(url string) error {
+	_, err := c.do("DEL", c.feedKey(url))
+	return err
 }
@@ -0,0 +1,247 @@
+package nimbus
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a cache living in the process, for running without Redis.
+// Beyond size values it evicts the least recently used, unless size is zero.
+type MemoryCache struct {
+	mutex     sync.Mutex
+	size      int
+	entries   map[string]*list.Element
+	recent    *list.List // Of *memoryEntry, most recently used first
+	aliases   map[string]string
+	requested map[string]bool
+}
+
+type memoryEntry struct {
+	url     string
+	value   string
+	expires time.Time // Zero if it never expires
+	updated time.Time
+}
+
+func NewMemoryCache(size int) *MemoryCache {
+	c := &MemoryCache{size: size}
+	c.Flush()
+	return c
+}
+
+func (c *MemoryCache) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.recent = list.New()
+	c.aliases = make(map[string]string)
+	c.requested = make(map[string]bool)
+	return nil
+}
+
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+// get returns the entry of a url, dropping it if it has expired.
+func (c *MemoryCache) get(url string) (*memoryEntry, bool) {
+	element, exists := c.entries[url]
+	if !exists {
+		return nil, false
+	}
+	entry := element.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.recent.MoveToFront(element)
+	return entry, true
+}
+
+// set stores the value of a url without expiry, evicting the least recently
+// used values beyond the size of the cache.
+func (c *MemoryCache) set(url string, value string) {
+	if entry, exists := c.get(url); exists {
+		entry.value = value
+		entry.expires = time.Time{}
+		entry.updated = time.Now()
+		return
+	}
+	c.entries[url] = c.recent.PushFront(&memoryEntry{url: url, value: value, updated: time.Now()})
+	for c.size > 0 && c.recent.Len() > c.size {
+		c.remove(c.recent.Back())
+	}
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*memoryEntry).url)
+}
+
+func (c *MemoryCache) Set(url string, value string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(url, value)
+	return nil
+}
+
+func (c *MemoryCache) SetEx(url string, value string, seconds int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(url, value)
+	c.expire(url, seconds)
+	return nil
+}
+
+func (c *MemoryCache) AddEx(url string, value string, seconds int) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.get(url); exists {
+		return false, nil
+	}
+	c.set(url, value)
+	c.expire(url, seconds)
+	return true, nil
+}
+
+func (c *MemoryCache) MarkPending(url string, seconds int) (bool, error) {
+	return c.AddEx(url, pendingMarker, seconds)
+}
+
+// Pending markers in memory are all this instance's own.
+func (c *MemoryCache) Pending(before time.Time) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pending := make([]string, 0)
+	for _, element := range c.entries {
+		entry := element.Value.(*memoryEntry)
+		expired := !entry.expires.IsZero() && !time.Now().Before(entry.expires)
+		if entry.value == pendingMarker && entry.updated.Before(before) && !expired {
+			pending = append(pending, entry.url)
+		}
+	}
+	return pending, nil
+}
+
+func (c *MemoryCache) MarkInvalid(url string, failure *Failure) error {
+	return markInvalid(c, url, failure)
+}
+
+func (c *MemoryCache) GetFailures(urls []string) (map[string]*Failure, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	failures := make(map[string]*Failure)
+	for _, url := range urls {
+		var failure Failure
+		if entry, exists := c.get(failureKey(url)); exists && json.Unmarshal([]byte(entry.value), &failure) == nil {
+			failures[url] = &failure
+		}
+	}
+	return failures, nil
+}
+
+func (c *MemoryCache) expire(url string, seconds int) {
+	if entry, exists := c.get(url); exists {
+		entry.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+}
+
+func (c *MemoryCache) Delete(url string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, exists := c.entries[url]; exists {
+		c.remove(element)
+	}
+	return nil
+}
+
+func (c *MemoryCache) SetFeed(url string, feed *Feed) error {
+	value, err := encodeFeed(url, feed)
+	if err != nil {
+		return err
+	}
+	return c.Set(url, value)
+}
+
+func (c *MemoryCache) AddFeed(url string, feed *Feed) error {
+	value, err := encodeFeed(url, feed)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.get(url); !exists {
+		c.set(url, value)
+	}
+	return nil
+}
+
+func (c *MemoryCache) SetAlias(alias string, original string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.aliases[alias] = original
+	return nil
+}
+
+func (c *MemoryCache) DeleteAlias(alias string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.aliases, alias)
+	return nil
+}
+
+// resolveAlias returns the key a url is cached under, pointing the aliases on
+// the way straight at the original.
+func (c *MemoryCache) resolveAlias(url string) string {
+	original, hops, err := resolveAlias(url, func(alias string) (string, error) {
+		if original, exists := c.aliases[alias]; exists {
+			return original, nil
+		}
+		return "", ErrNotFound
+	})
+	if err != nil {
+		return url
+	}
+	for _, hop := range hops {
+		c.aliases[hop] = original
+	}
+	return original
+}
+
+func (c *MemoryCache) GetFeeds(urls []string) (map[string]Value, []string, map[string]string, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	response := make(map[string]Value)
+	missing := make([]string, 0)
+	keys := make(map[string]string, len(urls))
+
+	for _, url := range urls {
+		key := c.resolveAlias(url)
+		keys[url] = key
+		c.requested[key] = true
+		value := pendingMarker
+		if entry, exists := c.get(key); exists {
+			value = entry.value
+		} else {
+			missing = append(missing, url)
+		}
+		response[url] = Value(value)
+	}
+
+	return response, missing, keys, nil
+}
+
+func (c *MemoryCache) TakeRequested() ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	urls := make([]string, 0, len(c.requested))
+	for url := range c.requested {
+		urls = append(urls, url)
+	}
+	c.requested = make(map[string]bool)
+	return urls, nil
+}
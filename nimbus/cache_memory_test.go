@@ -0,0 +1,121 @@
+package nimbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+
+	c := NewMemoryCache(0)
+	c.SetFeed("http://xkcd.com/rss.xml", &Feed{Title: "xkcd.com"})
+	c.SetAlias("http://xkcd.com/atom.xml", "http://xkcd.com/rss.xml")
+	marked, err := c.MarkPending("http://xkcd.com/rss.xml", 60)
+	expect(marked, false, t)
+	expect(err, nil, t)
+	marked, _ = c.MarkPending("http://example.com", 60)
+	expect(marked, true, t)
+	marked, _ = c.MarkPending("http://example.com", 60)
+	expect(marked, false, t)
+	c.SetEx("http://example.com", pendingMarker, 0)
+
+	response, missing, _, err := c.GetFeeds([]string{"http://xkcd.com/atom.xml", "http://example.com"})
+	expect(err, nil, t)
+	expect(len(missing), 1, t)
+	expect(missing[0], "http://example.com", t)
+	expect(string(response["http://example.com"]), "true", t)
+	expect(response["http://xkcd.com/atom.xml"].Compressed(), true, t)
+	feed, _ := response["http://xkcd.com/atom.xml"].JSON()
+	expect(string(feed[:20]), `{"title":"xkcd.com",`, t)
+
+	requested, _ := c.TakeRequested()
+	expect(len(requested), 2, t)
+	requested, _ = c.TakeRequested()
+	expect(len(requested), 0, t)
+
+	c.MarkInvalid("http://example.com", &Failure{Error: "Timeout", RetryAt: time.Now().Add(time.Minute)})
+	response, missing, _, _ = c.GetFeeds([]string{"http://example.com"})
+	expect(len(missing), 0, t)
+	expect(string(response["http://example.com"]), "false", t)
+	failures, err := c.GetFailures([]string{"http://example.com", "http://xkcd.com/rss.xml"})
+	expect(err, nil, t)
+	expect(len(failures), 1, t)
+	expect(failures["http://example.com"].Error, "Timeout", t)
+	c.entries["http://example.com"].Value.(*memoryEntry).expires = time.Now()
+	marked, _ = c.MarkPending("http://example.com", 60)
+	expect(marked, true, t)
+	c.Delete("http://example.com")
+	_, missing, _, _ = c.GetFeeds([]string{"http://example.com"})
+	expect(len(missing), 1, t)
+}
+
+func TestMemoryCacheAliases(t *testing.T) {
+
+	c := NewMemoryCache(0)
+	c.SetFeed("http://c.com", &Feed{Title: "c.com"})
+	c.SetAlias("http://a.com", "http://b.com")
+	c.SetAlias("http://b.com", "http://c.com")
+	c.SetAlias("http://d.com", "http://e.com")
+	c.SetAlias("http://e.com", "http://d.com")
+
+	response, missing, originals, err := c.GetFeeds([]string{"http://a.com", "http://d.com"})
+	expect(err, nil, t)
+	expect(originals["http://a.com"], "http://c.com", t)
+	expect(originals["http://d.com"], "http://d.com", t)
+	feed, _ := response["http://a.com"].JSON()
+	expect(string(feed[:17]), `{"title":"c.com",`, t)
+	expect(c.aliases["http://a.com"], "http://c.com", t)
+	expect(len(missing), 1, t)
+	expect(missing[0], "http://d.com", t)
+
+	c.DeleteAlias("http://a.com")
+	_, missing, _, _ = c.GetFeeds([]string{"http://a.com"})
+	expect(len(missing), 1, t)
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+
+	c := NewMemoryCache(3)
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("http://example.com/%d", i), "{}")
+	}
+	c.GetFeeds([]string{"http://example.com/0"})
+	c.Set("http://example.com/3", "{}")
+	c.Set("http://example.com/4", "{}")
+	expect(c.recent.Len(), 3, t)
+
+	_, missing, _, _ := c.GetFeeds([]string{
+		"http://example.com/0",
+		"http://example.com/1",
+		"http://example.com/2",
+		"http://example.com/3",
+		"http://example.com/4",
+	})
+	expect(len(missing), 2, t)
+	expect(missing[0], "http://example.com/1", t)
+	expect(missing[1], "http://example.com/2", t)
+}
+
+func TestMemoryCachePending(t *testing.T) {
+
+	c := NewMemoryCache(0)
+	c.MarkPending("http://example.com/lost", 60)
+	c.MarkPending("http://example.com/polled", 60)
+	c.SetFeed("http://example.com/polled", &Feed{Title: "Polled"})
+	c.MarkPending("http://example.com/expired", 60)
+	c.SetEx("http://example.com/expired", pendingMarker, 0)
+
+	pending, err := c.Pending(time.Now().Add(-time.Minute))
+	expect(err, nil, t)
+	expect(len(pending), 0, t)
+	pending, _ = c.Pending(time.Now().Add(time.Second))
+	expect(len(pending), 1, t)
+	expect(pending[0], "http://example.com/lost", t)
+
+	// Failures retried already are marked for a second rather than forever
+	c.MarkInvalid("http://example.com/lost", &Failure{Error: "Timeout", RetryAt: time.Now().Add(-time.Minute)})
+	entry, _ := c.get("http://example.com/lost")
+	expect(entry.value, invalidMarker, t)
+	expect(entry.expires.IsZero(), false, t)
+}
@@ -0,0 +1,339 @@
+package nimbus
+
+import (
+	"container/list"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	invalidationChannel = "invalidations"
+	invalidateAll       = "*" // Invalidates every key, no url is just that
+	invalidationMemory  = time.Minute
+)
+
+// TieredCache keeps the hottest feeds, and the aliases leading to them, in a
+// bounded cache in the process in front of Redis. Every change to Redis is
+// published, and every instance drops the changed key from its own cache.
+// While the subscription to changes is down nothing is served from or kept
+// in the process, as changes may be missed.
+type TieredCache struct {
+	remote *RedisCache
+	mutex  sync.Mutex
+	local  *MemoryCache // Guarded by mutex rather than its own
+	// Keys invalidated lately, by when, so that feeds read from Redis before
+	// they changed aren't kept. Rotated every invalidationMemory.
+	invalidated map[string]time.Time
+	previous    map[string]time.Time
+	rotated     time.Time
+	requested   map[string]bool
+	subscribed  bool
+	conn        redis.Conn
+	closed      chan struct{}
+}
+
+func NewTieredCache(remote *RedisCache, size int) *TieredCache {
+	c := newTieredCache(remote, size)
+	go c.subscribe()
+	return c
+}
+
+func newTieredCache(remote *RedisCache, size int) *TieredCache {
+	return &TieredCache{
+		remote:      remote,
+		local:       NewMemoryCache(size),
+		invalidated: make(map[string]time.Time),
+		previous:    make(map[string]time.Time),
+		rotated:     time.Now(),
+		requested:   make(map[string]bool),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Remote returns the Redis cache behind the cache in the process.
+func (c *TieredCache) Remote() *RedisCache {
+	return c.remote
+}
+
+// subscribe drops the keys any instance publishes from the cache in the
+// process, and everything when subscribing, until the cache is closed.
+func (c *TieredCache) subscribe() {
+	for {
+		conn := redis.PubSubConn{Conn: c.remote.backend.get(c.channel())}
+		c.mutex.Lock()
+		c.conn = conn.Conn
+		c.mutex.Unlock()
+		select {
+		case <-c.closed:
+			conn.Close()
+			return
+		default:
+		}
+
+		err := conn.Subscribe(c.channel())
+		for err == nil {
+			switch message := conn.Receive().(type) {
+			case redis.Subscription:
+				c.invalidate(invalidateAll)
+				c.mutex.Lock()
+				c.subscribed = true
+				c.mutex.Unlock()
+			case redis.Message:
+				c.invalidate(string(message.Data))
+			case error:
+				err = message
+			}
+		}
+
+		c.mutex.Lock()
+		c.subscribed = false
+		c.mutex.Unlock()
+		conn.Close()
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(time.Second):
+		}
+		log.Printf("Lost subscription to invalidations, subscribing again: %s", err)
+	}
+}
+
+// invalidate drops a key from the cache in the process.
+func (c *TieredCache) invalidate(key string) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.rotated) > invalidationMemory {
+		c.previous, c.invalidated, c.rotated = c.invalidated, make(map[string]time.Time), now
+	}
+	c.invalidated[key] = now
+
+	if key == invalidateAll {
+		c.local.entries = make(map[string]*list.Element)
+		c.local.recent.Init()
+	} else if element, exists := c.local.entries[key]; exists {
+		c.local.remove(element)
+	}
+}
+
+// invalidatedSince tells if a key was invalidated after the given time.
+func (c *TieredCache) invalidatedSince(key string, since time.Time) bool {
+	for _, invalidated := range []map[string]time.Time{c.invalidated, c.previous} {
+		if at, exists := invalidated[key]; exists && at.After(since) {
+			return true
+		}
+		if at, exists := invalidated[invalidateAll]; exists && at.After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish drops keys changed in Redis from the cache in the process, and
+// has every other instance drop them too.
+func (c *TieredCache) publish(keys ...string) error {
+	for _, key := range keys {
+		c.invalidate(key)
+	}
+	commands := make([]redisCommand, len(keys))
+	for i, key := range keys {
+		commands[i] = newCommand("PUBLISH", c.channel(), key)
+	}
+	_, err := c.remote.backend.pipeline(commands)
+	return err
+}
+
+// channel is where invalidations are published, behind the key prefix of
+// Redis. Redis Cluster passes messages on to every node.
+func (c *TieredCache) channel() string {
+	return c.remote.prefix + invalidationChannel
+}
+
+// localAliasKey is where what a url is an alias of is kept in the process, ""
+// if it is no alias.
+func localAliasKey(url string) string {
+	return "alias:" + url
+}
+
+// getLocal returns the value of a url from the cache in the process and the
+// key it is kept under, if it and every alias on the way are there.
+func (c *TieredCache) getLocal(url string) (Value, string, bool) {
+
+	if !c.subscribed {
+		return nil, "", false
+	}
+
+	key := url
+	seen := make(map[string]bool)
+	for !seen[key] {
+		seen[key] = true
+		alias, exists := c.local.get(localAliasKey(key))
+		if !exists {
+			return nil, "", false
+		}
+		if alias.value == "" {
+			if entry, exists := c.local.get(key); exists {
+				return Value(entry.value), key, true
+			}
+			return nil, "", false
+		}
+		key = alias.value
+	}
+	return nil, "", false
+}
+
+// keepLocal keeps the feeds and aliases read from Redis at the given time in
+// the cache in the process, leaving out what has changed since.
+func (c *TieredCache) keepLocal(at time.Time, values map[string]Value, keys map[string]string, hops map[string]string) {
+	if !c.subscribed || time.Since(at) > invalidationMemory {
+		return
+	}
+	for url, original := range hops {
+		if !c.invalidatedSince(localAliasKey(url), at) {
+			c.local.set(localAliasKey(url), original)
+		}
+	}
+	for url, value := range values {
+		if !value.marker() && !c.invalidatedSince(keys[url], at) {
+			c.local.set(keys[url], string(value))
+		}
+	}
+}
+
+func (c *TieredCache) Flush() error {
+	if err := c.remote.Flush(); err != nil {
+		return err
+	}
+	return c.publish(invalidateAll)
+}
+
+func (c *TieredCache) Close() error {
+	close(c.closed)
+	c.mutex.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mutex.Unlock()
+	return c.remote.Close()
+}
+
+// MarkPending only marks feeds that aren't cached, so there is nothing in the
+// process to drop.
+func (c *TieredCache) MarkPending(url string, seconds int) (bool, error) {
+	return c.remote.MarkPending(url, seconds)
+}
+
+// Pending markers are never kept in the process.
+func (c *TieredCache) Pending(before time.Time) ([]string, error) {
+	return c.remote.Pending(before)
+}
+
+func (c *TieredCache) MarkInvalid(url string, failure *Failure) error {
+	if err := c.remote.MarkInvalid(url, failure); err != nil {
+		return err
+	}
+	return c.publish(url)
+}
+
+func (c *TieredCache) Delete(url string) error {
+	if err := c.remote.Delete(url); err != nil {
+		return err
+	}
+	return c.publish(url)
+}
+
+func (c *TieredCache) SetFeed(url string, feed *Feed) error {
+	if err := c.remote.SetFeed(url, feed); err != nil {
+		return err
+	}
+	return c.publish(url)
+}
+
+func (c *TieredCache) AddFeed(url string, feed *Feed) error {
+	if err := c.remote.AddFeed(url, feed); err != nil {
+		return err
+	}
+	return c.publish(url)
+}
+
+func (c *TieredCache) SetAlias(alias string, original string) error {
+	if err := c.remote.SetAlias(alias, original); err != nil {
+		return err
+	}
+	return c.publish(localAliasKey(alias))
+}
+
+func (c *TieredCache) DeleteAlias(alias string) error {
+	if err := c.remote.DeleteAlias(alias); err != nil {
+		return err
+	}
+	return c.publish(localAliasKey(alias))
+}
+
+func (c *TieredCache) GetFeeds(urls []string) (map[string]Value, []string, map[string]string, error) {
+
+	response := make(map[string]Value)
+	originals := make(map[string]string, len(urls))
+	remote := make([]string, 0)
+
+	c.mutex.Lock()
+	for _, url := range urls {
+		if value, key, exists := c.getLocal(url); exists {
+			response[url] = value
+			originals[url] = key
+			c.requested[key] = true
+			continue
+		}
+		remote = append(remote, url)
+	}
+	c.mutex.Unlock()
+	if len(remote) == 0 {
+		return response, []string{}, originals, nil
+	}
+
+	at := time.Now()
+	values, missing, keys, hops, err := c.remote.getFeeds(remote)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c.mutex.Lock()
+	c.keepLocal(at, values, keys, hops)
+	c.mutex.Unlock()
+
+	for url, value := range values {
+		response[url] = value
+		originals[url] = keys[url]
+	}
+	return response, missing, originals, nil
+}
+
+func (c *TieredCache) GetFailures(urls []string) (map[string]*Failure, error) {
+	return c.remote.GetFailures(urls)
+}
+
+// TakeRequested returns the feeds requested from Redis and from the process.
+func (c *TieredCache) TakeRequested() ([]string, error) {
+
+	urls, err := c.remote.TakeRequested()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	taken := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		taken[url] = true
+	}
+	for url := range c.requested {
+		if !taken[url] {
+			urls = append(urls, url)
+		}
+	}
+	c.requested = make(map[string]bool)
+	return urls, nil
+}
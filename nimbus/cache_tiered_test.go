@@ -0,0 +1,49 @@
+package nimbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTieredCacheLocal(t *testing.T) {
+
+	c := newTieredCache(nil, 10)
+	feed := Value(`{"title":"xkcd.com"}`)
+	values := map[string]Value{"http://xkcd.com/atom.xml": feed, "http://example.com": Value(pendingMarker)}
+	keys := map[string]string{"http://xkcd.com/atom.xml": "http://xkcd.com/rss.xml", "http://example.com": "http://example.com"}
+	hops := map[string]string{"http://xkcd.com/atom.xml": "http://xkcd.com/rss.xml", "http://xkcd.com/rss.xml": "", "http://example.com": ""}
+
+	// Nothing is kept before subscribing, as changes could be missed
+	c.keepLocal(time.Now(), values, keys, hops)
+	_, _, exists := c.getLocal("http://xkcd.com/atom.xml")
+	expect(exists, false, t)
+
+	c.subscribed = true
+	c.keepLocal(time.Now(), values, keys, hops)
+	value, key, exists := c.getLocal("http://xkcd.com/atom.xml")
+	expect(exists, true, t)
+	expect(key, "http://xkcd.com/rss.xml", t)
+	expect(string(value), string(feed), t)
+	_, _, exists = c.getLocal("http://example.com")
+	expect(exists, false, t)
+
+	c.invalidate("http://xkcd.com/rss.xml")
+	_, _, exists = c.getLocal("http://xkcd.com/atom.xml")
+	expect(exists, false, t)
+
+	// Feeds read before they changed are not kept
+	read := time.Now().Add(-time.Second)
+	c.keepLocal(read, values, keys, hops)
+	_, _, exists = c.getLocal("http://xkcd.com/atom.xml")
+	expect(exists, false, t)
+	c.keepLocal(time.Now(), values, keys, hops)
+	c.invalidate(localAliasKey("http://xkcd.com/atom.xml"))
+	_, _, exists = c.getLocal("http://xkcd.com/atom.xml")
+	expect(exists, false, t)
+	_, _, exists = c.getLocal("http://xkcd.com/rss.xml")
+	expect(exists, true, t)
+
+	c.invalidate(invalidateAll)
+	_, _, exists = c.getLocal("http://xkcd.com/rss.xml")
+	expect(exists, false, t)
+}
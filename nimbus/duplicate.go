@@ -0,0 +1,234 @@
+package nimbus
+
+import (
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DuplicateSample is how many of the newest items of two feeds are compared.
+const DuplicateSample = 50
+
+// Weights of the evidence of two feeds being duplicates, adding up to one.
+const (
+	itemsWeight = 0.6
+	titleWeight = 0.2
+	linkWeight  = 0.2
+)
+
+// keyLinks sets the normalized links a feed and its items are found by among
+// the candidates for duplicates of another feed.
+func keyLinks(feed *Feed, items []Item) {
+	feed.LinkKey = normalizeLink(feed.Link)
+	for i := range items {
+		items[i].LinkKey = normalizeLink(items[i].URL)
+	}
+}
+
+// Duplication is the evidence of two feeds being the same feed at different
+// urls, and how confident it makes us.
+type Duplication struct {
+	Items      float64 `json:"items"` // Share of the items of both feeds found in both
+	Title      float64 `json:"title"` // Similarity of the titles, from 0 to 1
+	Link       bool    `json:"link"`  // Whether both link to the same site
+	Confidence float64 `json:"confidence"`
+}
+
+// CompareFeeds weighs the evidence of two feeds being duplicates. Items are
+// the same if they share their guid or link, links are compared without
+// their scheme, www. prefix and tracking parameters, and titles by their
+// pairs of letters.
+func CompareFeeds(a *Feed, b *Feed) Duplication {
+	d := Duplication{
+		Items: itemOverlap(a.Items, b.Items),
+		Title: similarity(normalizeTitle(a.Title), normalizeTitle(b.Title)),
+		Link:  a.Link != "" && normalizeLink(a.Link) == normalizeLink(b.Link),
+	}
+	d.Confidence = itemsWeight*d.Items + titleWeight*d.Title
+	if d.Link {
+		d.Confidence += linkWeight
+	}
+	return d
+}
+
+// itemOverlap returns the share of the sampled items of both feeds that they
+// have in common, over the time that both cover. A feed listing fewer items
+// than its duplicate covers less time, while a feed of a category of another
+// leaves out items of the time it covers.
+func itemOverlap(a []Item, b []Item) float64 {
+
+	if len(a) > DuplicateSample {
+		a = a[:DuplicateSample]
+	}
+	if len(b) > DuplicateSample {
+		b = b[:DuplicateSample]
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	// Items without a date could have been published any time
+	from, to := publishedBetween(a)
+	bFrom, bTo := publishedBetween(b)
+	if !from.IsZero() && !bFrom.IsZero() {
+		if bFrom.After(from) {
+			from = bFrom
+		}
+		if bTo.Before(to) {
+			to = bTo
+		}
+		a, b = publishedWithin(a, from, to), publishedWithin(b, from, to)
+		if len(a) == 0 || len(b) == 0 {
+			return 0
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, item := range b {
+		for _, key := range itemKeys(item) {
+			keys[key] = true
+		}
+	}
+	shared := 0
+	for _, item := range a {
+		for _, key := range itemKeys(item) {
+			if keys[key] {
+				shared++
+				break
+			}
+		}
+	}
+	if shared > len(b) {
+		shared = len(b)
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// publishedBetween returns when the first and the last of the items were
+// published.
+func publishedBetween(items []Item) (time.Time, time.Time) {
+	from, to := items[0].PublishedAt, items[0].PublishedAt
+	for _, item := range items[1:] {
+		if item.PublishedAt.Before(from) {
+			from = item.PublishedAt
+		}
+		if item.PublishedAt.After(to) {
+			to = item.PublishedAt
+		}
+	}
+	return from, to
+}
+
+// publishedWithin leaves out the items published outside of the given time.
+func publishedWithin(items []Item, from time.Time, to time.Time) []Item {
+	within := make([]Item, 0, len(items))
+	for _, item := range items {
+		if !item.PublishedAt.Before(from) && !item.PublishedAt.After(to) {
+			within = append(within, item)
+		}
+	}
+	return within
+}
+
+// sampleKeys returns the guids and normalized links of the sampled items of a
+// feed, for finding the feeds that might share them.
+func sampleKeys(items []Item) ([]string, []string) {
+	if len(items) > DuplicateSample {
+		items = items[:DuplicateSample]
+	}
+	var guids, links []string
+	for _, item := range items {
+		if item.GUID != "" {
+			guids = append(guids, item.GUID)
+		}
+		if item.URL != "" {
+			links = append(links, normalizeLink(item.URL))
+		}
+	}
+	return guids, links
+}
+
+// itemKeys are what identifies an item across feeds.
+func itemKeys(item Item) []string {
+	var keys []string
+	if item.GUID != "" {
+		keys = append(keys, "guid:"+item.GUID)
+	}
+	if item.URL != "" {
+		keys = append(keys, "link:"+normalizeLink(item.URL))
+	}
+	return keys
+}
+
+// normalizeLink leaves out the parts of a link that differ between feeds of
+// the same site.
+func normalizeLink(link string) string {
+
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(link)
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	query := u.Query()
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") || key == "fbclid" || key == "gclid" {
+			query.Del(key)
+		}
+	}
+	normalized := host + strings.TrimSuffix(u.Path, "/")
+	if len(query) > 0 {
+		normalized += "?" + query.Encode()
+	}
+	return normalized
+}
+
+// normalizeTitle keeps the letters and digits of a title, in lower case.
+func normalizeTitle(title string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, title)
+}
+
+// similarity is the Dice coefficient of the pairs of letters of two strings.
+func similarity(a string, b string) float64 {
+
+	if a == b {
+		if a == "" {
+			return 0
+		}
+		return 1
+	}
+	pa, pb := pairs(a), pairs(b)
+	if len(pa) == 0 || len(pb) == 0 {
+		return 0
+	}
+
+	counts := make(map[string]int)
+	for _, pair := range pa {
+		counts[pair]++
+	}
+	shared := 0
+	for _, pair := range pb {
+		if counts[pair] > 0 {
+			counts[pair]--
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(pa)+len(pb))
+}
+
+func pairs(s string) []string {
+	runes := []rune(s)
+	if len(runes) < 2 {
+		return nil
+	}
+	pairs := make([]string, len(runes)-1)
+	for i := range pairs {
+		pairs[i] = string(runes[i : i+2])
+	}
+	return pairs
+}
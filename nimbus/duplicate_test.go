@@ -0,0 +1,73 @@
+package nimbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompareFeeds(t *testing.T) {
+
+	// The atom feed lists an older item than the rss feed still does
+	day := time.Date(2015, 4, 1, 0, 0, 0, 0, time.UTC)
+	rss := &Feed{Title: "xkcd.com", Link: "http://xkcd.com/", Items: []Item{
+		Item{GUID: "http://xkcd.com/1516/", URL: "http://xkcd.com/1516/", PublishedAt: day.AddDate(0, 0, 2)},
+		Item{GUID: "http://xkcd.com/1515/", URL: "http://xkcd.com/1515/", PublishedAt: day.AddDate(0, 0, 1)},
+	}}
+	atom := &Feed{Title: "xkcd", Link: "https://www.xkcd.com", Items: []Item{
+		Item{GUID: "tag:1516", URL: "https://xkcd.com/1516/?utm_source=feed", PublishedAt: day.AddDate(0, 0, 2)},
+		Item{GUID: "tag:1515", URL: "https://xkcd.com/1515/", PublishedAt: day.AddDate(0, 0, 1)},
+		Item{GUID: "tag:1514", URL: "https://xkcd.com/1514/", PublishedAt: day},
+	}}
+	d := CompareFeeds(rss, atom)
+	expect(d.Items, 1.0, t)
+	expect(d.Link, true, t)
+	if d.Confidence < 0.9 {
+		t.Errorf("Expected the feeds to be duplicates - Got %+v", d)
+	}
+
+	// Feeds of one site sharing a few items are not duplicates
+	comics := &Feed{Title: "xkcd: Comics about Physics", Link: "http://xkcd.com/", Items: []Item{
+		Item{GUID: "http://xkcd.com/1515/", URL: "http://xkcd.com/1515/"},
+		Item{GUID: "http://xkcd.com/1400/", URL: "http://xkcd.com/1400/"},
+		Item{GUID: "http://xkcd.com/1300/", URL: "http://xkcd.com/1300/"},
+	}}
+	d = CompareFeeds(rss, comics)
+	expect(d.Items, 0.25, t)
+	if d.Confidence >= 0.75 {
+		t.Errorf("Expected the feeds to be told apart - Got %+v", d)
+	}
+
+	// A feed of a category of a site has every item of it in the site's feed,
+	// but leaves out the others published meanwhile
+	site := &Feed{Title: "Ars Technica", Link: "https://arstechnica.com"}
+	category := &Feed{Title: "Ars Technica - Science", Link: "https://arstechnica.com"}
+	for i := 0; i < 20; i++ {
+		item := Item{GUID: fmt.Sprintf("https://arstechnica.com/?p=%d", i), PublishedAt: day.Add(time.Duration(-i) * time.Hour)}
+		site.Items = append(site.Items, item)
+		if i%4 == 0 {
+			category.Items = append(category.Items, item)
+		}
+	}
+	d = CompareFeeds(site, category)
+	expect(d.Items, 5.0/17, t)
+	if d.Confidence >= 0.75 {
+		t.Errorf("Expected the category feed to be told apart - Got %+v", d)
+	}
+
+	// Nearly empty feeds have nothing in common
+	d = CompareFeeds(&Feed{Title: "Blog"}, &Feed{Title: "Notes"})
+	expect(d.Items, 0.0, t)
+	expect(d.Link, false, t)
+	if d.Confidence >= 0.75 {
+		t.Errorf("Expected the feeds to be told apart - Got %+v", d)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	expect(similarity("xkcd", "xkcd"), 1.0, t)
+	expect(similarity("", ""), 0.0, t)
+	expect(similarity("night", "nacht"), 0.25, t)
+	expect(normalizeTitle("The Verge -  All Posts"), "thevergeallposts", t)
+	expect(normalizeLink("https://www.Example.com/post/?utm_medium=feed&id=2"), "example.com/post?id=2", t)
+}
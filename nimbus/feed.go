@@ -28,14 +28,23 @@ var (
 )
 
 type Feed struct {
-	ID         int       `json:"-"`
-	Title      string    `json:"title"`
-	URL        string    `json:"url" sql:"unique_index"`
-	Items      []Item    `json:"items"`
-	Sum        string    `json:"-" sql:"index"`
-	NextPollAt time.Time `json:"next_poll_at" sql:"index"`
-	CreatedAt  time.Time `json:"-"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID          int       `json:"-"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url" sql:"unique_index"`
+	Link        string    `json:"link" sql:"index"`
+	LinkKey     string    `json:"-" sql:"index"`
+	Items       []Item    `json:"items"`
+	Sum         string    `json:"-" sql:"index"`
+	NextPollAt  time.Time `json:"next_poll_at" sql:"index"`
+	Activity    string    `json:"-" sql:"type:text"`
+	RequestedAt time.Time `json:"-" sql:"index"`
+	Dormant     bool      `json:"-" sql:"index"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	LastError   string    `json:"error,omitempty" sql:"type:text"`
+	Gone        bool      `json:"gone,omitempty"`
+	Listed      int       `json:"-"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type Item struct {
@@ -44,10 +53,37 @@ type Item struct {
 	Title       string    `json:"title"`
 	Teaser      string    `json:"teaser" sql:"type:text"`
 	URL         string    `json:"url"`
-	GUID        string    `json:"guid" sql:"index"`
+	LinkKey     string    `json:"-" sql:"index"`
+	GUID        string    `json:"guid"`
 	PublishedAt time.Time `json:"published_at"`
+	Starred     bool      `json:"-" sql:"index"`
+	Updated     bool      `json:"updated" sql:"-"`
 	CreatedAt   time.Time `json:"-"`
-	UpdatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Revision keeps what an item said before its publisher changed it.
+type Revision struct {
+	ID        int       `json:"-"`
+	ItemID    int       `json:"-" sql:"index"`
+	Title     string    `json:"title"`
+	Teaser    string    `json:"teaser" sql:"type:text"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"replaced_at"`
+}
+
+// revise records the item as it was if the other item changes it, which
+// it then does.
+func (i *Item) revise(changed Item, at time.Time) *Revision {
+	if i.Title == changed.Title && i.Teaser == changed.Teaser && i.URL == changed.URL {
+		return nil
+	}
+	revision := &Revision{ItemID: i.ID, Title: i.Title, Teaser: i.Teaser, URL: i.URL, CreatedAt: at}
+	i.Title = changed.Title
+	i.Teaser = changed.Teaser
+	i.URL = changed.URL
+	i.UpdatedAt = at
+	return revision
 }
 
 func (f Feed) Timeout() time.Duration {
@@ -110,6 +146,7 @@ func NewFeed(url string, data []byte) (*Feed, error) {
 		f.UpdatedAt = time.Now()
 	}
 	f.URL = limitStringLength(url, 255)
+	f.Link = limitStringLength(f.Link, 255)
 	f.NextPollAt = time.Now().Add(f.Timeout())
 	f.UpdatedAt = time.Now()
 	return f, nil
@@ -144,6 +181,7 @@ func NewFeedFromRSS(rf *rss.Feed) *Feed {
 
 	return &Feed{
 		Title: rf.Channel.Title,
+		Link:  rc.Link(),
 		Items: items,
 		Sum:   Sum(rf.Raw),
 	}
@@ -174,6 +212,7 @@ func NewFeedFromAtom(af *atom.Feed) *Feed {
 
 	return &Feed{
 		Title: af.Title,
+		Link:  af.Link(),
 		Items: items,
 		Sum:   Sum(af.Raw),
 	}
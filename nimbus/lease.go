@@ -0,0 +1,47 @@
+package nimbus
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Only release a lease if it is still ours, it may have expired and been
+// claimed by another instance in the meantime.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lease claims feeds in Redis so that several instances can share the work of
+// polling without polling the same feed twice. A claim expires by itself if
+// the instance holding it crashes.
+type Lease struct {
+	cache *RedisCache
+	owner string
+	ttl   time.Duration
+}
+
+func NewLease(c *RedisCache, owner string, ttl time.Duration) *Lease {
+	return &Lease{cache: c, owner: owner, ttl: ttl}
+}
+
+func (l *Lease) Acquire(url string) (bool, error) {
+	reply, err := redis.String(l.cache.do("SET", l.cache.leaseKey(url), l.owner, "NX", "PX", int64(l.ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (l *Lease) Release(url string) error {
+	key := l.cache.leaseKey(url)
+	conn := l.cache.backend.get(key)
+	defer conn.Close()
+	_, err := releaseScript.Do(conn, key, l.owner)
+	return err
+}
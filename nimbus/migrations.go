@@ -0,0 +1,610 @@
+package nimbus
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Migration changes the schema from the previous version to Version. Up and
+// Down are run in a transaction, with {{id}}, {{time}} and {{bool}} standing in
+// for the column types of the database. A migration for Only one database is
+// recorded without running anything on the others.
+type Migration struct {
+	Version int
+	Name    string
+	Only    string
+	Up      []string
+	Down    []string
+}
+
+// Migrations are applied in order, and undone in reverse order.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create feed, item and alias",
+		Up: []string{
+			`CREATE TABLE feed (
+				id {{id}},
+				title varchar(255),
+				url varchar(255),
+				sum varchar(255),
+				next_poll_at {{time}},
+				activity text,
+				requested_at {{time}},
+				dormant {{bool}},
+				created_at {{time}},
+				updated_at {{time}}
+			)`,
+			"CREATE UNIQUE INDEX uix_feed_url ON feed (url)",
+			"CREATE INDEX idx_feed_sum ON feed (sum)",
+			"CREATE INDEX idx_feed_next_poll_at ON feed (next_poll_at)",
+			"CREATE INDEX idx_feed_requested_at ON feed (requested_at)",
+			"CREATE INDEX idx_feed_dormant ON feed (dormant)",
+			`CREATE TABLE item (
+				id {{id}},
+				feed_id integer,
+				title varchar(255),
+				teaser text,
+				url varchar(255),
+				guid varchar(255),
+				published_at {{time}},
+				starred {{bool}},
+				created_at {{time}},
+				updated_at {{time}}
+			)`,
+			"CREATE INDEX idx_item_feed_id ON item (feed_id)",
+			"CREATE UNIQUE INDEX idx_item_feed_id_guid ON item (feed_id, guid)",
+			"CREATE INDEX idx_item_starred ON item (starred)",
+			`CREATE TABLE alias (
+				id {{id}},
+				alias varchar(255),
+				original varchar(255),
+				created_at {{time}}
+			)`,
+			"CREATE UNIQUE INDEX uix_alias_alias ON alias (alias)",
+			"CREATE INDEX idx_alias_original ON alias (original)",
+		},
+		Down: []string{
+			"DROP TABLE alias",
+			"DROP TABLE item",
+			"DROP TABLE feed",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create revision",
+		Up: []string{
+			`CREATE TABLE revision (
+				id {{id}},
+				item_id integer,
+				title varchar(255),
+				teaser text,
+				url varchar(255),
+				created_at {{time}}
+			)`,
+			"CREATE INDEX idx_revision_item_id ON revision (item_id)",
+			// Items were touched by every poll, from now on only by changes
+			"UPDATE item SET updated_at = created_at",
+		},
+		Down: []string{
+			"DROP TABLE revision",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "search items",
+		Only:    "postgres",
+		Up: []string{
+			"ALTER TABLE item ADD COLUMN search tsvector",
+			"UPDATE item SET search = " + searchVector("title", "teaser"),
+			"CREATE INDEX idx_item_search ON item USING GIN (search)",
+		},
+		Down: []string{
+			"DROP INDEX idx_item_search",
+			"ALTER TABLE item DROP COLUMN search",
+		},
+	},
+	{
+		Version: 4,
+		Name:    "record poll results",
+		Only:    "postgres",
+		Up:      pollResults,
+		Down: []string{
+			"ALTER TABLE feed DROP COLUMN fetched_at",
+			"ALTER TABLE feed DROP COLUMN last_error",
+			"ALTER TABLE feed DROP COLUMN gone",
+		},
+	},
+	{
+		Version: 5,
+		Name:    "record poll results on sqlite",
+		Only:    "sqlite3",
+		Up:      pollResults,
+		Down:    rebuildFeed("", feedColumns),
+	},
+	{
+		Version: 6,
+		Name:    "unalias aliases",
+		Only:    "postgres",
+		Up:      unaliasAliases,
+		Down: []string{
+			"ALTER TABLE alias DROP COLUMN unaliased",
+		},
+	},
+	{
+		Version: 7,
+		Name:    "unalias aliases on sqlite",
+		Only:    "sqlite3",
+		Up:      unaliasAliases,
+		Down: []string{
+			fmt.Sprintf(aliasTable, "alias_rebuilt"),
+			"INSERT INTO alias_rebuilt SELECT id, alias, original, created_at FROM alias",
+			"DROP TABLE alias",
+			"ALTER TABLE alias_rebuilt RENAME TO alias",
+			"CREATE UNIQUE INDEX uix_alias_alias ON alias (alias)",
+			"CREATE INDEX idx_alias_original ON alias (original)",
+		},
+	},
+	{
+		Version: 8,
+		Name:    "find duplicate feeds",
+		Only:    "postgres",
+		Up:      findDuplicates,
+		Down: []string{
+			"DROP INDEX idx_item_url",
+			"DROP INDEX idx_item_guid",
+			"DROP INDEX idx_feed_link",
+			"ALTER TABLE feed DROP COLUMN link",
+		},
+	},
+	{
+		Version: 9,
+		Name:    "find duplicate feeds on sqlite",
+		Only:    "sqlite3",
+		Up:      findDuplicates,
+		Down: append([]string{
+			"DROP INDEX idx_item_url",
+			"DROP INDEX idx_item_guid",
+		}, rebuildFeed(pollColumns, feedColumns+", fetched_at, last_error, gone")...),
+	},
+	{
+		Version: 10,
+		Name:    "keep listed items",
+		Only:    "postgres",
+		Up:      listedItems,
+		Down: []string{
+			"ALTER TABLE feed DROP COLUMN listed",
+		},
+	},
+	{
+		Version: 11,
+		Name:    "keep listed items on sqlite",
+		Only:    "sqlite3",
+		Up:      listedItems,
+		Down: append(rebuildFeed(pollColumns+linkColumn, feedColumns+", fetched_at, last_error, gone, link"),
+			"CREATE INDEX idx_feed_link ON feed (link)"),
+	},
+	{
+		Version: 12,
+		Name:    "normalize links",
+		Only:    "postgres",
+		Up:      normalizeLinks,
+		Down: []string{
+			"CREATE INDEX idx_feed_link ON feed (link)",
+			"CREATE INDEX idx_item_url ON item (url)",
+			"DROP INDEX idx_feed_link_key",
+			"DROP INDEX idx_item_link_key",
+			"ALTER TABLE feed DROP COLUMN link_key",
+			"ALTER TABLE item DROP COLUMN link_key",
+		},
+	},
+	{
+		Version: 13,
+		Name:    "normalize links on sqlite",
+		Only:    "sqlite3",
+		Up:      normalizeLinks,
+		Down: append(append(
+			rebuildFeed(pollColumns+linkColumn+listedColumn, feedColumns+", fetched_at, last_error, gone, link, listed"),
+			"CREATE INDEX idx_feed_link ON feed (link)"),
+			rebuildItem()...),
+	},
+}
+
+// Migrations that differ between databases, as SQLite can't drop columns, are
+// split in one for each, sharing what they do on the way up.
+var (
+	pollResults = []string{
+		"ALTER TABLE feed ADD COLUMN fetched_at {{time}}",
+		"ALTER TABLE feed ADD COLUMN last_error text",
+		"ALTER TABLE feed ADD COLUMN gone {{bool}}",
+		"UPDATE feed SET fetched_at = updated_at, last_error = '', gone = false",
+	}
+	unaliasAliases = []string{
+		"ALTER TABLE alias ADD COLUMN unaliased {{bool}}",
+		"UPDATE alias SET unaliased = false",
+	}
+	findDuplicates = []string{
+		"ALTER TABLE feed ADD COLUMN link varchar(255)",
+		"UPDATE feed SET link = ''",
+		"CREATE INDEX idx_feed_link ON feed (link)",
+		"CREATE INDEX idx_item_guid ON item (guid)",
+		"CREATE INDEX idx_item_url ON item (url)",
+	}
+	listedItems = []string{
+		"ALTER TABLE feed ADD COLUMN listed integer",
+		"UPDATE feed SET listed = 0",
+	}
+	// Links already stored are keyed as their feeds are polled again
+	normalizeLinks = []string{
+		"ALTER TABLE feed ADD COLUMN link_key varchar(255)",
+		"ALTER TABLE item ADD COLUMN link_key varchar(255)",
+		"UPDATE feed SET link_key = ''",
+		"UPDATE item SET link_key = ''",
+		"CREATE INDEX idx_feed_link_key ON feed (link_key)",
+		"CREATE INDEX idx_item_link_key ON item (link_key)",
+		"DROP INDEX idx_feed_link",
+		"DROP INDEX idx_item_url",
+	}
+)
+
+// feedTable creates the feed table as of the first version, given its name
+// and the columns added since.
+const feedTable = `CREATE TABLE %s (
+	id {{id}},
+	title varchar(255),
+	url varchar(255),
+	sum varchar(255),
+	next_poll_at {{time}},
+	activity text,
+	requested_at {{time}},
+	dormant {{bool}},
+	created_at {{time}},
+	updated_at {{time}}%s
+)`
+
+// feedColumns are the columns of the feed table as of the first version.
+const feedColumns = "id, title, url, sum, next_poll_at, activity, requested_at, dormant, created_at, updated_at"
+
+// pollColumns are the columns added to the feed table by the fourth version.
+const pollColumns = `,
+	fetched_at {{time}},
+	last_error text,
+	gone {{bool}}`
+
+// linkColumn is the column added to the feed table by the eighth version.
+const linkColumn = `,
+	link varchar(255)`
+
+// listedColumn is the column added to the feed table by the tenth version.
+const listedColumn = `,
+	listed integer`
+
+// feedIndexes are the indexes of the feed table as of the first version, for
+// rebuilding it.
+var feedIndexes = []string{
+	"CREATE UNIQUE INDEX uix_feed_url ON feed (url)",
+	"CREATE INDEX idx_feed_sum ON feed (sum)",
+	"CREATE INDEX idx_feed_next_poll_at ON feed (next_poll_at)",
+	"CREATE INDEX idx_feed_requested_at ON feed (requested_at)",
+	"CREATE INDEX idx_feed_dormant ON feed (dormant)",
+}
+
+// rebuildFeed rebuilds the feed table on SQLite, which can't drop columns,
+// with the columns of the first version and those given, copying the copied
+// columns of every feed.
+func rebuildFeed(columns string, copied string) []string {
+	statements := []string{
+		fmt.Sprintf(feedTable, "feed_rebuilt", columns),
+		"INSERT INTO feed_rebuilt SELECT " + copied + " FROM feed",
+		"DROP TABLE feed",
+		"ALTER TABLE feed_rebuilt RENAME TO feed",
+	}
+	return append(statements, feedIndexes...)
+}
+
+// itemTable creates the item table as of the first version, given its name.
+const itemTable = `CREATE TABLE %s (
+	id {{id}},
+	feed_id integer,
+	title varchar(255),
+	teaser text,
+	url varchar(255),
+	guid varchar(255),
+	published_at {{time}},
+	starred {{bool}},
+	created_at {{time}},
+	updated_at {{time}}
+)`
+
+// rebuildItem rebuilds the item table on SQLite as of the eighth version,
+// copying every item.
+func rebuildItem() []string {
+	return []string{
+		fmt.Sprintf(itemTable, "item_rebuilt"),
+		"INSERT INTO item_rebuilt SELECT id, feed_id, title, teaser, url, guid, published_at, starred, created_at, updated_at FROM item",
+		"DROP TABLE item",
+		"ALTER TABLE item_rebuilt RENAME TO item",
+		"CREATE INDEX idx_item_feed_id ON item (feed_id)",
+		"CREATE UNIQUE INDEX idx_item_feed_id_guid ON item (feed_id, guid)",
+		"CREATE INDEX idx_item_starred ON item (starred)",
+		"CREATE INDEX idx_item_guid ON item (guid)",
+		"CREATE INDEX idx_item_url ON item (url)",
+	}
+}
+
+// aliasTable creates the alias table as of the first version, given its name.
+const aliasTable = `CREATE TABLE %s (
+	id {{id}},
+	alias varchar(255),
+	original varchar(255),
+	created_at {{time}}
+)`
+
+// searchVector weighs words in the title of an item above those in its teaser.
+func searchVector(title string, teaser string) string {
+	return fmt.Sprintf("setweight(to_tsvector('english', coalesce(%s, '')), 'A') || setweight(to_tsvector('english', coalesce(%s, '')), 'B')", title, teaser)
+}
+
+// columnTypes fill in the column types of each database in migrations.
+var columnTypes = map[string]*strings.Replacer{
+	"postgres": strings.NewReplacer(
+		"{{id}}", "serial PRIMARY KEY",
+		"{{time}}", "timestamp with time zone",
+		"{{bool}}", "boolean",
+	),
+	"sqlite3": strings.NewReplacer(
+		"{{id}}", "integer PRIMARY KEY AUTOINCREMENT",
+		"{{time}}", "datetime",
+		"{{bool}}", "boolean",
+	),
+}
+
+// LatestVersion is the version of the schema once every migration is applied.
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the schema, zero if it is empty. It
+// only reads the schema, leaving adopting it to Migrate.
+func (s *SQLStore) SchemaVersion() (int, error) {
+	version, err := s.recordedVersion()
+	// Databases from before migrations were versioned are at the first version
+	if err == nil && version == 0 && s.db.HasTable("feed") {
+		version = 1
+	}
+	return version, err
+}
+
+// recordedVersion returns the latest version recorded as applied, zero if
+// none is.
+func (s *SQLStore) recordedVersion() (int, error) {
+	if !s.db.HasTable("schema_migrations") {
+		return 0, nil
+	}
+	var versions []int
+	if err := s.db.Table("schema_migrations").Pluck("version", &versions).Error; err != nil {
+		return 0, err
+	}
+	version := 0
+	for _, v := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Migrate brings the schema to the given version, applying or undoing each
+// migration in between in its own transaction. Other instances migrating at
+// the same time wait for it on postgres.
+func (s *SQLStore) Migrate(version int) error {
+
+	if version < 0 || version > LatestVersion() {
+		return fmt.Errorf("Unknown schema version %d", version)
+	}
+	unlock, err := s.lockSchema()
+	if err != nil {
+		return fmt.Errorf("Failed to lock schema: %s", err)
+	}
+	defer unlock()
+	if err = s.versionSchema(); err != nil {
+		return err
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return fmt.Errorf("Schema version %d is newer than %d, the latest known", current, LatestVersion())
+	}
+
+	for _, migration := range Migrations {
+		if migration.Version <= current || migration.Version > version {
+			continue
+		}
+		if err := s.migrate(migration, true); err != nil {
+			return fmt.Errorf("Failed to apply migration %d: %s", migration.Version, err)
+		}
+	}
+
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		migration := Migrations[i]
+		if migration.Version > current || migration.Version <= version {
+			continue
+		}
+		if err := s.migrate(migration, false); err != nil {
+			return fmt.Errorf("Failed to undo migration %d: %s", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaLock is the key of the advisory lock taken while migrating postgres.
+const schemaLock = 0x6e696d627573
+
+// lockSchema keeps other instances from migrating postgres until unlocked, by
+// holding a transaction with an advisory lock. SQLite takes one writer at a
+// time, and migrate fails to record a migration another instance recorded.
+func (s *SQLStore) lockSchema() (func(), error) {
+	if s.dialect != "postgres" {
+		return func() {}, nil
+	}
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", schemaLock).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return func() { tx.Rollback() }, nil
+}
+
+// versionSchema creates the table recording the migrations applied, adopting
+// the schema if it was created before.
+func (s *SQLStore) versionSchema() error {
+
+	if err := s.db.Exec(s.columnTypes.Replace(
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name varchar(255), applied_at {{time}})",
+	)).Error; err != nil {
+		return err
+	}
+
+	version, err := s.recordedVersion()
+	if err != nil || version > 0 || !s.db.HasTable("feed") {
+		return err
+	}
+	if err = s.adoptSchema(); err != nil {
+		return fmt.Errorf("Failed to adopt schema: %s", err)
+	}
+	return nil
+}
+
+// statements leaves out those of migrations for other databases.
+func (s *SQLStore) statements(migration Migration, statements []string) []string {
+	if migration.Only != "" && migration.Only != s.dialect {
+		return nil
+	}
+	return statements
+}
+
+// migrate applies or undoes a migration. It is recorded before its statements
+// run, so that one applied or undone by another instance meanwhile fails
+// rather than running twice.
+func (s *SQLStore) migrate(migration Migration, up bool) error {
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	var record *gorm.DB
+	statements := migration.Down
+	if up {
+		statements = migration.Up
+		record = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			migration.Version, migration.Name, time.Now())
+	} else {
+		record = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+	}
+	if record.Error == nil && record.RowsAffected != 1 {
+		record.Error = fmt.Errorf("Migration %d is not applied", migration.Version)
+	}
+	if record.Error != nil {
+		tx.Rollback()
+		return record.Error
+	}
+	for _, statement := range s.statements(migration, statements) {
+		if err := tx.Exec(s.columnTypes.Replace(statement)).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// adoptSchema brings tables created by AutoMigrate, at any earlier revision,
+// to the first version and records it as applied.
+func (s *SQLStore) adoptSchema() error {
+
+	db := s.db.AutoMigrate(&adoptedFeed{}, &adoptedItem{}, &adoptedAlias{})
+	if db.Error != nil {
+		return db.Error
+	}
+
+	// Items are upserted by guid, which needs guids to be unique per feed
+	statements := []string{
+		"DROP INDEX IF EXISTS idx_item_guid",
+		"DELETE FROM item WHERE id NOT IN (SELECT MIN(id) FROM item GROUP BY feed_id, guid)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_item_feed_id_guid ON item (feed_id, guid)",
+	}
+	for _, statement := range statements {
+		if err := s.db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	// Feeds from before requests were tracked count as requested now
+	updates := []*gorm.DB{
+		s.db.Model(&adoptedFeed{}).Where("requested_at IS NULL").UpdateColumn("requested_at", time.Now()),
+		s.db.Model(&adoptedFeed{}).Where("dormant IS NULL").UpdateColumn("dormant", false),
+		s.db.Model(&adoptedItem{}).Where("starred IS NULL").UpdateColumn("starred", false),
+	}
+	for _, update := range updates {
+		if update.Error != nil {
+			return update.Error
+		}
+	}
+
+	return s.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		Migrations[0].Version, Migrations[0].Name, time.Now()).Error
+}
+
+// The tables as of the first version, for adopting the schema. These must not
+// change along with Feed, Item and Alias.
+type adoptedFeed struct {
+	ID          int
+	Title       string
+	URL         string    `sql:"unique_index"`
+	Sum         string    `sql:"index"`
+	NextPollAt  time.Time `sql:"index"`
+	Activity    string    `sql:"type:text"`
+	RequestedAt time.Time `sql:"index"`
+	Dormant     bool      `sql:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (adoptedFeed) TableName() string {
+	return "feed"
+}
+
+type adoptedItem struct {
+	ID          int
+	FeedID      int `sql:"index"`
+	Title       string
+	Teaser      string `sql:"type:text"`
+	URL         string
+	GUID        string
+	PublishedAt time.Time
+	Starred     bool `sql:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (adoptedItem) TableName() string {
+	return "item"
+}
+
+type adoptedAlias struct {
+	ID        int
+	Alias     string `sql:"unique_index"`
+	Original  string `sql:"index"`
+	CreatedAt time.Time
+}
+
+func (adoptedAlias) TableName() string {
+	return "alias"
+}
@@ -0,0 +1,121 @@
+package nimbus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrationOrder(t *testing.T) {
+	for i, migration := range Migrations {
+		expect(migration.Version, i+1, t)
+		expect(len(migration.Up) > 0, true, t)
+		expect(len(migration.Down) > 0, true, t)
+	}
+}
+
+// openSQLiteStore opens an empty store in a directory removed by the returned
+// function.
+func openSQLiteStore(t *testing.T) (*SQLStore, func()) {
+	dir, err := ioutil.TempDir("", "nimbus")
+	if err != nil {
+		t.Fatalf("Failed to make directory: %s", err)
+	}
+	s, err := NewSQLiteStore(filepath.Join(dir, "nimbus.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+
+	s, remove := openSQLiteStore(t)
+	defer remove()
+
+	version, err := s.SchemaVersion()
+	expect(err, nil, t)
+	expect(version, 0, t)
+
+	expect(s.Migrate(LatestVersion()), nil, t)
+	version, _ = s.SchemaVersion()
+	expect(version, LatestVersion(), t)
+	expect(s.db.HasTable("item"), true, t)
+	expect(s.SaveFeed(&Feed{URL: "http://xkcd.com/rss.xml", Items: []Item{Item{GUID: "1"}}}, nil), nil, t)
+
+	expect(s.Migrate(0), nil, t)
+	version, _ = s.SchemaVersion()
+	expect(version, 0, t)
+	expect(s.db.HasTable("item"), false, t)
+
+	expect(s.Migrate(LatestVersion()), nil, t)
+	expect(s.Migrate(LatestVersion()), nil, t)
+	expect(s.Migrate(LatestVersion()+1) != nil, true, t)
+
+	// Migrations applied or undone by another instance meanwhile are not run again
+	expect(s.migrate(Migrations[1], true) != nil, true, t)
+	expect(s.Migrate(1), nil, t)
+	expect(s.migrate(Migrations[1], false) != nil, true, t)
+	version, _ = s.SchemaVersion()
+	expect(version, 1, t)
+	expect(s.Migrate(LatestVersion()), nil, t)
+	_, err = s.Feed("http://xkcd.com/rss.xml")
+	expect(err, ErrNotFound, t)
+}
+
+// The tables as AutoMigrate created them before requests were tracked.
+type legacyFeed struct {
+	ID         int
+	Title      string
+	URL        string `sql:"unique_index"`
+	Sum        string `sql:"index"`
+	NextPollAt time.Time
+}
+
+func (legacyFeed) TableName() string {
+	return "feed"
+}
+
+type legacyItem struct {
+	ID     int
+	FeedID int    `sql:"index"`
+	GUID   string `sql:"index"`
+}
+
+func (legacyItem) TableName() string {
+	return "item"
+}
+
+func TestAdoptSchema(t *testing.T) {
+
+	s, remove := openSQLiteStore(t)
+	defer remove()
+
+	s.db.AutoMigrate(&legacyFeed{}, &legacyItem{})
+	s.db.Create(&legacyFeed{URL: "http://xkcd.com/rss.xml"})
+	s.db.Create(&legacyItem{FeedID: 1, GUID: "1"})
+	s.db.Create(&legacyItem{FeedID: 1, GUID: "1"})
+
+	version, err := s.SchemaVersion()
+	expect(err, nil, t)
+	expect(version, 1, t)
+	expect(s.db.HasTable("schema_migrations"), false, t)
+	var count int
+	s.db.Table("item").Count(&count)
+	expect(count, 2, t)
+	expect(s.Migrate(LatestVersion()), nil, t)
+
+	feed, err := s.Feed("http://xkcd.com/rss.xml")
+	expect(err, nil, t)
+	expect(feed.RequestedAt.IsZero(), false, t)
+	expect(feed.Dormant, false, t)
+	items, _ := s.Items(feed.ID, 0)
+	expect(len(items), 1, t)
+	expect(s.SaveFeed(feed, nil), nil, t)
+}
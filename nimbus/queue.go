@@ -0,0 +1,358 @@
+package nimbus
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+)
+
+// Popularity counts how often feeds are requested, once per client each
+// round. Counts decay over time so feeds nobody reads anymore drift back to
+// the baseline weight. At most limit feeds are counted, feeds beyond that keep
+// the baseline weight until Prune makes room, and at most limit hits each
+// round.
+type Popularity struct {
+	mutex    sync.Mutex
+	halfLife time.Duration
+	limit    int
+	scores   map[string]popularityScore
+	hits     map[string]float64 // Counted this round, by url
+	clients  map[string]bool    // "<client> <url>" of the hits this round
+}
+
+type popularityScore struct {
+	value float64
+	at    time.Time
+}
+
+// popularityFloor is the score below which feeds are forgotten.
+const popularityFloor = 0.01
+
+func NewPopularity(halfLife time.Duration, limit int) *Popularity {
+	return &Popularity{
+		halfLife: halfLife,
+		limit:    limit,
+		scores:   make(map[string]popularityScore),
+		hits:     make(map[string]float64),
+		clients:  make(map[string]bool),
+	}
+}
+
+func (p *Popularity) decayed(s popularityScore, now time.Time) float64 {
+	return s.value * math.Exp2(-now.Sub(s.at).Hours()/p.halfLife.Hours())
+}
+
+// Hit counts a request of a client for a feed, unless the client has already
+// requested it this round.
+func (p *Popularity) Hit(url string, client string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	hit := client + " " + url
+	if p.clients[hit] || len(p.clients) >= p.limit {
+		return
+	}
+	score, exists := p.scores[url]
+	if !exists && len(p.scores) >= p.limit {
+		return
+	}
+	now := time.Now()
+	p.scores[url] = popularityScore{p.decayed(score, now) + 1, now}
+	p.hits[url]++
+	p.clients[hit] = true
+}
+
+// Weight is 1 for feeds that are never requested and grows slowly with the
+// number of recent requests.
+func (p *Popularity) Weight(url string) float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return 1 + math.Log2(1+p.decayed(p.scores[url], time.Now()))
+}
+
+// Prune forgets feeds whose requests have all but decayed away.
+func (p *Popularity) Prune() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for url, s := range p.scores {
+		if p.decayed(s, now) < popularityFloor {
+			delete(p.scores, url)
+		}
+	}
+}
+
+// Round starts a new round, in which every client is counted anew. Given a
+// share, the hits of the last round are handed to it to be added to those of
+// other instances, and the scores it returns replace those of this instance.
+// Otherwise feeds whose requests have decayed away are pruned. Hits a failed
+// share didn't take are handed to it again next round.
+func (p *Popularity) Round(share func(hits map[string]float64) (map[string]float64, error)) error {
+
+	p.mutex.Lock()
+	hits := p.hits
+	p.hits = make(map[string]float64)
+	p.clients = make(map[string]bool)
+	p.mutex.Unlock()
+
+	if share == nil {
+		p.Prune()
+		return nil
+	}
+	scores, err := share(hits)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		for url, count := range hits {
+			p.hits[url] += count
+		}
+		return err
+	}
+
+	// Hits counted while sharing are shared next round
+	now := time.Now()
+	p.scores = make(map[string]popularityScore, len(scores))
+	for url, score := range scores {
+		p.scores[url] = popularityScore{score, now}
+	}
+	for url, count := range p.hits {
+		score := p.scores[url]
+		p.scores[url] = popularityScore{score.value + count, now}
+	}
+	return nil
+}
+
+// Queue is a bounded priority queue of feeds to poll. Urgent feeds go first,
+// then feeds somebody is waiting for, then feeds that are merely due. Within
+// each class feeds are ordered by how overdue they are, weighted by their
+// popularity at the time they were pushed. A feed is claimed when it is popped
+// and can't be queued again until it is released.
+type Queue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	weight  func(string) float64
+	items   queueItems
+	claimed map[string]bool
+	closed  bool
+}
+
+type queueItem struct {
+	url       string
+	due       time.Time
+	weight    float64
+	requested bool
+	urgent    bool
+}
+
+type queueItems struct {
+	items []*queueItem
+	now   time.Time
+}
+
+// class is 2 for urgent feeds, 1 for requested feeds and 0 for the rest.
+func (item *queueItem) class() int {
+	switch {
+	case item.urgent:
+		return 2
+	case item.requested:
+		return 1
+	}
+	return 0
+}
+
+func (item *queueItem) score(now time.Time) float64 {
+	overdue := now.Sub(item.due).Seconds()
+	if overdue < 1 {
+		overdue = 1
+	}
+	return overdue * item.weight
+}
+
+// before tells if an item is polled before another.
+func (item *queueItem) before(other *queueItem, now time.Time) bool {
+	if item.class() != other.class() {
+		return item.class() > other.class()
+	}
+	return item.score(now) > other.score(now)
+}
+
+func (qi queueItems) Len() int {
+	return len(qi.items)
+}
+
+func (qi queueItems) Less(i, j int) bool {
+	return qi.items[i].before(qi.items[j], qi.now)
+}
+
+func (qi queueItems) Swap(i, j int) {
+	qi.items[i], qi.items[j] = qi.items[j], qi.items[i]
+}
+
+func (qi *queueItems) Push(x interface{}) {
+	qi.items = append(qi.items, x.(*queueItem))
+}
+
+func (qi *queueItems) Pop() interface{} {
+	n := len(qi.items)
+	item := qi.items[n-1]
+	qi.items = qi.items[:n-1]
+	return item
+}
+
+func NewQueue(limit int, weight func(string) float64) *Queue {
+	q := &Queue{limit: limit, weight: weight, claimed: make(map[string]bool)}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push adds a feed to the queue. When the queue is full the feed displaces the
+// lowest priority feed, which is returned, or is rejected if it has the lowest
+// priority itself. Feeds are always rejected once the queue is closed, and
+// while they are claimed.
+func (q *Queue) Push(url string, due time.Time) (evicted string, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.push(&queueItem{url: url, due: due, weight: q.weight(url)})
+}
+
+// Urgent moves a feed ahead of all feeds that are not urgent, adding it to the
+// queue if it is not there already. At most a tenth of the queue is urgent, so
+// that urgent feeds can't starve the rest, beyond that feeds are rejected, as
+// are claimed feeds.
+func (q *Queue) Urgent(url string) (evicted string, ok bool) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	item := q.find(url)
+	if item != nil && item.urgent {
+		return "", !q.closed
+	}
+	if q.urgent() >= q.urgentLimit() {
+		return "", false
+	}
+	if item != nil {
+		item.urgent = true
+		return "", !q.closed
+	}
+	return q.push(&queueItem{url: url, due: time.Now(), weight: q.weight(url), urgent: true})
+}
+
+// Request moves a feed somebody is waiting for ahead of feeds that are merely
+// due, adding it to the queue if it is not there already and not claimed.
+func (q *Queue) Request(url string) (evicted string, ok bool) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if item := q.find(url); item != nil {
+		item.requested = true
+		return "", !q.closed
+	}
+	return q.push(&queueItem{url: url, due: time.Now(), weight: q.weight(url), requested: true})
+}
+
+func (q *Queue) urgent() int {
+	urgent := 0
+	for _, item := range q.items.items {
+		if item.urgent {
+			urgent++
+		}
+	}
+	return urgent
+}
+
+func (q *Queue) urgentLimit() int {
+	if q.limit < 10 {
+		return 1
+	}
+	return q.limit / 10
+}
+
+func (q *Queue) find(url string) *queueItem {
+	for _, item := range q.items.items {
+		if item.url == url {
+			return item
+		}
+	}
+	return nil
+}
+
+func (q *Queue) push(item *queueItem) (evicted string, ok bool) {
+
+	if q.closed || q.claimed[item.url] {
+		return "", false
+	}
+
+	q.items.now = time.Now()
+
+	if q.items.Len() >= q.limit {
+		lowest := 0
+		for i, queued := range q.items.items {
+			if q.items.items[lowest].before(queued, q.items.now) {
+				lowest = i
+			}
+		}
+		if !item.before(q.items.items[lowest], q.items.now) {
+			return "", false
+		}
+		evicted = q.items.items[lowest].url
+		heap.Remove(&q.items, lowest)
+	}
+
+	heap.Push(&q.items, item)
+	q.cond.Signal()
+	return evicted, true
+}
+
+// Pop blocks until a feed is queued and claims and returns the one with
+// highest priority, or returns false once the queue is closed.
+func (q *Queue) Pop() (string, bool) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.items.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return "", false
+	}
+
+	// Priorities shift as time passes
+	q.items.now = time.Now()
+	heap.Init(&q.items)
+	url := heap.Pop(&q.items).(*queueItem).url
+	q.claimed[url] = true
+	return url, true
+}
+
+// Claimed tells if a feed has been popped and not released since.
+func (q *Queue) Claimed(url string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.claimed[url]
+}
+
+// Release lets a popped feed be queued again.
+func (q *Queue) Release(url string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.claimed, url)
+}
+
+// Close wakes up all blocked calls to Pop. Feeds left in the queue stay put.
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.items.Len()
+}
@@ -0,0 +1,178 @@
+package nimbus
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueueOverdue(t *testing.T) {
+	q := NewQueue(10, func(string) float64 { return 1 })
+	now := time.Now()
+	q.Push("b", now.Add(-time.Minute))
+	q.Push("a", now.Add(-time.Hour))
+	q.Push("c", now.Add(time.Minute))
+	expect(pop(q), "a", t)
+	expect(pop(q), "b", t)
+	expect(pop(q), "c", t)
+	expect(q.Len(), 0, t)
+}
+
+func TestQueuePopularity(t *testing.T) {
+	p := NewPopularity(time.Hour, 100)
+	for i := 0; i < 100; i++ {
+		p.Hit("popular", fmt.Sprint(i))
+	}
+	q := NewQueue(10, p.Weight)
+	now := time.Now()
+	q.Push("unrequested", now.Add(-2*time.Hour))
+	q.Push("popular", now.Add(-time.Hour))
+	expect(pop(q), "popular", t)
+	expect(pop(q), "unrequested", t)
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(2, func(string) float64 { return 1 })
+	now := time.Now()
+	q.Push("a", now.Add(-time.Hour))
+	q.Push("b", now.Add(-time.Minute))
+	evicted, ok := q.Push("c", now)
+	expect(ok, false, t)
+	evicted, ok = q.Push("d", now.Add(-2*time.Hour))
+	expect(ok, true, t)
+	expect(evicted, "b", t)
+	expect(pop(q), "d", t)
+	expect(pop(q), "a", t)
+}
+
+func TestQueueRequested(t *testing.T) {
+	q := NewQueue(2, func(string) float64 { return 1 })
+	now := time.Now()
+	q.Push("overdue", now.Add(-time.Hour))
+	q.Push("due", now.Add(-time.Minute))
+
+	// A new feed somebody is waiting for displaces feeds that are merely due
+	evicted, ok := q.Request("new")
+	expect(ok, true, t)
+	expect(evicted, "due", t)
+	q.Request("overdue")
+	q.Urgent("urgent")
+	expect(pop(q), "urgent", t)
+	expect(pop(q), "overdue", t)
+	expect(q.Len(), 0, t)
+}
+
+func TestQueueUrgentLimit(t *testing.T) {
+	q := NewQueue(20, func(string) float64 { return 1 })
+	q.Push("due", time.Now())
+	for _, url := range []string{"a", "b", "c"} {
+		q.Urgent(url)
+	}
+	_, ok := q.Urgent("due")
+	expect(ok, false, t)
+	expect(q.Len(), 3, t)
+	expect(pop(q) != "due", true, t)
+	_, ok = q.Urgent("due")
+	expect(ok, true, t)
+}
+
+func TestQueueClaimed(t *testing.T) {
+	q := NewQueue(10, func(string) float64 { return 1 })
+	q.Push("a", time.Now())
+	expect(pop(q), "a", t)
+	expect(q.Claimed("a"), true, t)
+
+	// A feed being polled is not queued again until it is released
+	_, ok := q.Request("a")
+	expect(ok, false, t)
+	_, ok = q.Urgent("a")
+	expect(ok, false, t)
+	expect(q.Len(), 0, t)
+	q.Release("a")
+	expect(q.Claimed("a"), false, t)
+	_, ok = q.Request("a")
+	expect(ok, true, t)
+}
+
+func TestPopularityLimit(t *testing.T) {
+	p := NewPopularity(time.Hour, 1)
+	p.Hit("a", "x")
+	p.Hit("b", "y")
+	p.Round(nil)
+	p.Hit("b", "y")
+	p.Hit("a", "x")
+	expect(len(p.scores), 1, t)
+	expect(p.Weight("b"), 1.0, t)
+	expect(p.Weight("a") > 2, true, t)
+}
+
+func TestPopularityClients(t *testing.T) {
+	p := NewPopularity(time.Hour, 100)
+	for i := 0; i < 10; i++ {
+		p.Hit("a", "x")
+	}
+	p.Hit("b", "x")
+	p.Hit("b", "y")
+	expect(p.Weight("a") < p.Weight("b"), true, t)
+
+	// Clients are counted anew every round
+	p.Round(nil)
+	p.Hit("a", "x")
+	p.Hit("a", "x")
+	expect(p.Weight("a") > 2 && p.Weight("a") < 2.6, true, t)
+}
+
+func TestPopularityShare(t *testing.T) {
+	p := NewPopularity(time.Hour, 100)
+	p.Hit("a", "x")
+	p.Hit("b", "x")
+
+	var shared map[string]float64
+	err := p.Round(func(hits map[string]float64) (map[string]float64, error) {
+		shared = hits
+		return map[string]float64{"a": 7, "c": 3}, nil
+	})
+	expect(err, nil, t)
+	expect(len(shared), 2, t)
+	expect(shared["a"], 1.0, t)
+	expect(p.scores["a"].value, 7.0, t)
+	expect(p.scores["c"].value, 3.0, t)
+	expect(p.Weight("b"), 1.0, t)
+
+	// Hits a failed share didn't take are shared next round
+	p.Hit("d", "x")
+	p.Round(func(map[string]float64) (map[string]float64, error) {
+		return nil, errors.New("Unreachable")
+	})
+	p.Hit("d", "y")
+	p.Round(func(hits map[string]float64) (map[string]float64, error) {
+		shared = hits
+		return hits, nil
+	})
+	expect(shared["d"], 2.0, t)
+}
+
+func TestPopularityPrune(t *testing.T) {
+	p := NewPopularity(time.Nanosecond, 100)
+	p.Hit("a", "x")
+	time.Sleep(time.Millisecond)
+	p.Prune()
+	expect(len(p.scores), 0, t)
+	expect(p.Weight("a"), 1.0, t)
+}
+
+func TestQueueClose(t *testing.T) {
+	q := NewQueue(10, func(string) float64 { return 1 })
+	go q.Close()
+	_, ok := q.Pop()
+	expect(ok, false, t)
+	_, ok = q.Push("a", time.Now())
+	expect(ok, false, t)
+	expect(q.Len(), 0, t)
+}
+
+func pop(q *Queue) string {
+	url, _ := q.Pop()
+	return url
+}
@@ -0,0 +1,506 @@
+package nimbus
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots = 16384
+	maxRedirects = 5
+)
+
+// redisCommand is a Redis command on the key that is its first argument.
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+func newCommand(name string, args ...interface{}) redisCommand {
+	return redisCommand{name: name, args: args}
+}
+
+// key returns the key of the command, "" if it has none.
+func (c redisCommand) key() string {
+	if len(c.args) == 0 {
+		return ""
+	}
+	key, _ := c.args[0].(string)
+	return key
+}
+
+// repeatable tells if running the command twice leaves Redis as running it
+// once does, so that it can be sent again when its reply was lost.
+func (c redisCommand) repeatable() bool {
+	switch c.name {
+	case "GET", "DEL", "SADD", "ZADD", "ZREM", "ZRANGEBYSCORE", "ZREVRANGE", "ZREMRANGEBYSCORE", "PUBLISH":
+		return true
+	case "SET":
+		for i := 2; i < len(c.args); i++ {
+			if option, _ := c.args[i].(string); strings.EqualFold(option, "NX") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// redisBackend reaches a single Redis, or every node of a Redis Cluster.
+type redisBackend interface {
+	// pipeline runs commands in as few round trips as it can, returning
+	// their replies in order, error replies as redis.Error.
+	pipeline(commands []redisCommand) ([]interface{}, error)
+	// get returns a connection to the node holding a key.
+	get(key string) redis.Conn
+	// masters returns the pools of every node holding keys.
+	masters() ([]*redis.Pool, error)
+	close() error
+}
+
+// http://godoc.org/github.com/garyburd/redigo/redis#Pool
+func newPool(dial func() (redis.Conn, error), test func(c redis.Conn, t time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:      20,
+		IdleTimeout:  240 * time.Second,
+		Dial:         dial,
+		TestOnBorrow: test,
+	}
+}
+
+func ping(c redis.Conn, t time.Time) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// runPipeline sends commands over a connection and receives their replies.
+func runPipeline(conn redis.Conn, commands []redisCommand) ([]interface{}, error) {
+	for _, command := range commands {
+		conn.Send(command.name, command.args...)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := receive(conn)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// receive receives a reply, returning error replies as replies.
+func receive(conn redis.Conn) (interface{}, error) {
+	reply, err := conn.Receive()
+	if e, ok := err.(redis.Error); ok {
+		return e, nil
+	}
+	return reply, err
+}
+
+// singleRedis is a single Redis, found directly or through Sentinel.
+type singleRedis struct {
+	pool *redis.Pool
+}
+
+func newSingleRedis(server string) *singleRedis {
+	return &singleRedis{pool: newPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", server)
+	}, ping)}
+}
+
+// newSentinelRedis connects to whichever Redis the sentinels tell is the
+// master, dropping connections to a master that has since been demoted.
+func newSentinelRedis(sentinels []string, master string) *singleRedis {
+	return &singleRedis{pool: newPool(func() (redis.Conn, error) {
+		server, err := sentinelMaster(sentinels, master)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Dial("tcp", server)
+	}, func(c redis.Conn, t time.Time) error {
+		role, err := redis.Values(c.Do("ROLE"))
+		if err != nil {
+			return err
+		}
+		if len(role) == 0 {
+			return fmt.Errorf("Redis has no role")
+		}
+		if name, _ := redis.String(role[0], nil); name != "master" {
+			return fmt.Errorf("Redis is no longer the master of %s", master)
+		}
+		return nil
+	})}
+}
+
+// sentinelMaster asks the sentinels in turn for the address of the master.
+func sentinelMaster(sentinels []string, master string) (string, error) {
+	var err error
+	for _, sentinel := range sentinels {
+		var conn redis.Conn
+		conn, err = redis.Dial("tcp", sentinel, redis.DialConnectTimeout(time.Second))
+		if err != nil {
+			continue
+		}
+		var reply []string
+		reply, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", master))
+		conn.Close()
+		if err == nil && len(reply) == 2 {
+			return net.JoinHostPort(reply[0], reply[1]), nil
+		}
+		if err == nil || err == redis.ErrNil {
+			err = fmt.Errorf("Sentinel %s doesn't know %s", sentinel, master)
+		}
+	}
+	return "", fmt.Errorf("Failed to find master %s: %s", master, err)
+}
+
+func (r *singleRedis) pipeline(commands []redisCommand) ([]interface{}, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	return runPipeline(conn, commands)
+}
+
+func (r *singleRedis) get(key string) redis.Conn {
+	return r.pool.Get()
+}
+
+func (r *singleRedis) masters() ([]*redis.Pool, error) {
+	return []*redis.Pool{r.pool}, nil
+}
+
+func (r *singleRedis) close() error {
+	return r.pool.Close()
+}
+
+// clusterRedis sends every command to the master holding the slot of its
+// key, learning which one that is from the cluster, and following the
+// cluster when slots move.
+type clusterRedis struct {
+	seeds []string
+	mutex sync.Mutex
+	slots []string // Address of the master of each slot, nil until loaded
+	pools map[string]*redis.Pool
+}
+
+func newClusterRedis(seeds []string) *clusterRedis {
+	return &clusterRedis{seeds: seeds, pools: make(map[string]*redis.Pool)}
+}
+
+// keySlot returns the slot of a key, only hashing the part within the first
+// braces if there is something within them.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parseRedirect parses a MOVED or ASK error reply, returning the kind of
+// redirect and where to.
+func parseRedirect(reply redis.Error) (string, string, bool) {
+	fields := strings.Fields(string(reply))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+func (r *clusterRedis) pool(server string) *redis.Pool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	pool, exists := r.pools[server]
+	if !exists {
+		// Nodes that are down are given up on soon, to try the others
+		pool = newPool(func() (redis.Conn, error) {
+			return redis.Dial("tcp", server, redis.DialConnectTimeout(time.Second))
+		}, ping)
+		r.pools[server] = pool
+	}
+	return pool
+}
+
+// refresh loads which master holds each slot from the first node that
+// answers, trying the nodes known before the seeds.
+func (r *clusterRedis) refresh() error {
+
+	r.mutex.Lock()
+	servers := make([]string, 0, len(r.pools)+len(r.seeds))
+	for server := range r.pools {
+		servers = append(servers, server)
+	}
+	servers = append(servers, r.seeds...)
+	r.mutex.Unlock()
+
+	var err error
+	for _, server := range servers {
+		var slots []string
+		if slots, err = r.loadSlots(server); err == nil {
+			r.mutex.Lock()
+			r.slots = slots
+			r.mutex.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("Failed to load cluster slots: %s", err)
+}
+
+func (r *clusterRedis) loadSlots(server string) ([]string, error) {
+
+	conn := r.pool(server).Get()
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]string, clusterSlots)
+	for _, reply := range ranges {
+		fields, err := redis.Values(reply, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("Unexpected cluster slots from %s", server)
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		node, err := redis.Values(fields[2], nil)
+		if err != nil || len(node) < 2 {
+			return nil, fmt.Errorf("Unexpected cluster slots from %s", server)
+		}
+		host, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		if host == "" || host == "?" {
+			// The master is reached the way the node answering was
+			host, _, _ = net.SplitHostPort(server)
+		}
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	return slots, nil
+}
+
+// node returns the address of the master holding a key, loading the slots
+// first if they aren't, and falling back to the first seed.
+func (r *clusterRedis) node(key string) string {
+	r.mutex.Lock()
+	loaded := r.slots != nil
+	r.mutex.Unlock()
+	if !loaded {
+		if err := r.refresh(); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.slots != nil && r.slots[keySlot(key)] != "" {
+		return r.slots[keySlot(key)]
+	}
+	return r.seeds[0]
+}
+
+// pipeline pipelines the commands of each master over a connection of its
+// own, sending to every master before receiving from any. Commands whose
+// slot has moved are sent again where the cluster redirects them to. Should a
+// master fail to answer, the slots are loaded again from the nodes that do
+// and the commands left unanswered are sent once more, as the cluster may
+// have failed over. Only commands that can safely run twice are: the error is
+// returned for the others, which may have run before the answer was lost.
+func (r *clusterRedis) pipeline(commands []redisCommand) ([]interface{}, error) {
+	replies, answered, err := r.send(commands)
+	if err == nil {
+		return replies, nil
+	}
+	if refreshErr := r.refresh(); refreshErr != nil {
+		log.Printf("%s", refreshErr)
+		return nil, err
+	}
+
+	var unanswered []int
+	for i, command := range commands {
+		if answered[i] {
+			continue
+		}
+		if !command.repeatable() {
+			return nil, err
+		}
+		unanswered = append(unanswered, i)
+	}
+	again := make([]redisCommand, len(unanswered))
+	for j, i := range unanswered {
+		again[j] = commands[i]
+	}
+	resent, _, err := r.send(again)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range unanswered {
+		replies[i] = resent[j]
+	}
+	return replies, nil
+}
+
+// send runs the commands on the masters holding their keys, following
+// redirects. It tells which commands were answered, as a master failing to
+// answer leaves the replies of the others.
+func (r *clusterRedis) send(commands []redisCommand) ([]interface{}, []bool, error) {
+
+	var servers []string
+	byServer := make(map[string][]int)
+	for i, command := range commands {
+		server := r.node(command.key())
+		if _, exists := byServer[server]; !exists {
+			servers = append(servers, server)
+		}
+		byServer[server] = append(byServer[server], i)
+	}
+
+	var failed error
+	var flushed []string
+	conns := make(map[string]redis.Conn, len(servers))
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, server := range servers {
+		conn := r.pool(server).Get()
+		conns[server] = conn
+		for _, i := range byServer[server] {
+			conn.Send(commands[i].name, commands[i].args...)
+		}
+		if err := conn.Flush(); err != nil {
+			failed = err
+			continue
+		}
+		flushed = append(flushed, server)
+	}
+
+	replies := make([]interface{}, len(commands))
+	answered := make([]bool, len(commands))
+	for _, server := range flushed {
+		for _, i := range byServer[server] {
+			reply, err := receive(conns[server])
+			if err != nil {
+				failed = err
+				break
+			}
+			replies[i], answered[i] = reply, true
+		}
+	}
+
+	moved := false
+	for i := range replies {
+		for redirects := 0; answered[i] && redirects < maxRedirects; redirects++ {
+			reply, isError := replies[i].(redis.Error)
+			if !isError {
+				break
+			}
+			kind, server, redirected := parseRedirect(reply)
+			if !redirected {
+				break
+			}
+			moved = moved || kind == "MOVED"
+			var err error
+			if replies[i], err = r.redirect(kind, server, commands[i]); err != nil {
+				replies[i], answered[i], failed = nil, false, err
+			}
+		}
+	}
+	if moved {
+		if err := r.refresh(); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+
+	return replies, answered, failed
+}
+
+// redirect sends a command to the node the cluster redirected it to, asking
+// first if the slot is only being migrated there.
+func (r *clusterRedis) redirect(kind string, server string, command redisCommand) (interface{}, error) {
+	conn := r.pool(server).Get()
+	defer conn.Close()
+	commands := []redisCommand{command}
+	if kind == "ASK" {
+		commands = []redisCommand{newCommand("ASKING"), command}
+	}
+	replies, err := runPipeline(conn, commands)
+	if err != nil {
+		return nil, err
+	}
+	return replies[len(replies)-1], nil
+}
+
+// get returns a connection to the master holding a key, loading the slots
+// again if it can't be reached.
+func (r *clusterRedis) get(key string) redis.Conn {
+	conn := r.pool(r.node(key)).Get()
+	if conn.Err() == nil {
+		return conn
+	}
+	conn.Close()
+	if err := r.refresh(); err != nil {
+		log.Printf("%s", err)
+	}
+	return r.pool(r.node(key)).Get()
+}
+
+func (r *clusterRedis) masters() ([]*redis.Pool, error) {
+	r.node("")
+	r.mutex.Lock()
+	slots := r.slots
+	r.mutex.Unlock()
+	if slots == nil {
+		return nil, fmt.Errorf("Cluster slots are unknown")
+	}
+
+	var pools []*redis.Pool
+	seen := make(map[string]bool)
+	for _, server := range slots {
+		if server != "" && !seen[server] {
+			seen[server] = true
+			pools = append(pools, r.pool(server))
+		}
+	}
+	return pools, nil
+}
+
+func (r *clusterRedis) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var err error
+	for _, pool := range r.pools {
+		if closeErr := pool.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
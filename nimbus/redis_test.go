@@ -0,0 +1,444 @@
+package nimbus
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+
+	expect(crc16("123456789"), uint16(0x31C3), t)
+	expect(keySlot("foo"), 12182, t)
+	expect(keySlot("{user1000}.following"), keySlot("{user1000}.followers"), t)
+	expect(keySlot("{user1000}.following"), keySlot("user1000"), t)
+
+	// Only the first braces count, and only with something within them
+	expect(keySlot("foo{}{bar}"), int(crc16("foo{}{bar}")%clusterSlots), t)
+	expect(keySlot("foo{{bar}}zap"), keySlot("{bar"), t)
+	expect(keySlot("foo{bar}{zap}"), keySlot("bar"), t)
+}
+
+func TestRedisKeys(t *testing.T) {
+
+	c, err := NewRedisCache(RedisOptions{Server: "localhost:6379", Prefix: "nimbus:"})
+	expect(err, nil, t)
+	defer c.Close()
+
+	url := "http://xkcd.com/rss.xml"
+	expect(c.feedKey(url), "nimbus:feed:{http://xkcd.com/rss.xml}", t)
+	expect(c.requestedKey(), "nimbus:requested", t)
+
+	// Every key of a feed lands on the same node
+	slot := keySlot(c.feedKey(url))
+	expect(keySlot(c.failureKey(url)), slot, t)
+	expect(keySlot(c.aliasKey(url)), slot, t)
+	expect(keySlot(c.leaseKey(url)), slot, t)
+	expect(keySlot(c.feedKey("http://example.com")) != slot, true, t)
+
+	_, err = NewRedisCache(RedisOptions{Prefix: "{nimbus}"})
+	expect(err != nil, true, t)
+	_, err = NewRedisCache(RedisOptions{Instance: "my host"})
+	expect(err != nil, true, t)
+	_, err = NewRedisCache(RedisOptions{Sentinels: []string{"localhost:26379"}})
+	expect(err != nil, true, t)
+}
+
+func TestParseRedirect(t *testing.T) {
+
+	kind, server, redirected := parseRedirect(redis.Error("MOVED 3999 127.0.0.1:6381"))
+	expect(kind, "MOVED", t)
+	expect(server, "127.0.0.1:6381", t)
+	expect(redirected, true, t)
+
+	kind, server, redirected = parseRedirect(redis.Error("ASK 3999 127.0.0.1:6381"))
+	expect(kind, "ASK", t)
+	expect(redirected, true, t)
+
+	_, _, redirected = parseRedirect(redis.Error("ERR wrong number of arguments"))
+	expect(redirected, false, t)
+}
+
+// fakeNode is a Redis Cluster node on a local port, answering every command
+// but ASKING with what answer returns, in RESP, or dropping the connection
+// unanswered if that is empty. Answer is told the address of the node and
+// whether the connection asked first.
+type fakeNode struct {
+	listener net.Listener
+	answer   func(node string, command []string, asking bool) string
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+func newFakeNode(answer func(node string, command []string, asking bool) string, t *testing.T) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	n := &fakeNode{listener: listener, answer: answer}
+	go n.serve()
+	return n
+}
+
+func (n *fakeNode) addr() string {
+	return n.listener.Addr().String()
+}
+
+func (n *fakeNode) serve() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.mutex.Lock()
+		n.conns = append(n.conns, conn)
+		n.mutex.Unlock()
+		go n.handle(conn)
+	}
+}
+
+func (n *fakeNode) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	asking := false
+	for {
+		command, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if strings.ToUpper(command[0]) == "ASKING" {
+			asking = true
+			io.WriteString(conn, "+OK\r\n")
+			continue
+		}
+		reply := n.answer(n.addr(), command, asking)
+		if reply == "" {
+			// The command ran, but its reply is lost
+			return
+		}
+		io.WriteString(conn, reply)
+		asking = false
+	}
+}
+
+// close takes the node down, dropping its connections.
+func (n *fakeNode) close() {
+	n.listener.Close()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("Unexpected command %q", line)
+	}
+	command := make([]string, count)
+	for i := range command {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		command[i] = string(data[:size])
+	}
+	return command, nil
+}
+
+func TestClusterRedirects(t *testing.T) {
+
+	// Every slot is held by the owner, as far as CLUSTER SLOTS tells, while
+	// the key is only answered by the target. Others redirect to it.
+	var mutex sync.Mutex
+	var owner, target, redirect string
+	set := func(o string, tg string, rd string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		owner, target, redirect = o, tg, rd
+	}
+	answer := func(node string, command []string, asking bool) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch strings.ToUpper(command[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "CLUSTER":
+			host, port, _ := net.SplitHostPort(owner)
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", clusterSlots-1, len(host), host, port)
+		case "GET":
+			if node == target || (asking && redirect == "ASK") {
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(node), node)
+			}
+			return fmt.Sprintf("-%s %d %s\r\n", redirect, keySlot(command[1]), target)
+		}
+		return "-ERR unknown command\r\n"
+	}
+	a, b := newFakeNode(answer, t), newFakeNode(answer, t)
+	defer a.close()
+	defer b.close()
+
+	r := newClusterRedis([]string{a.addr(), b.addr()})
+	defer r.close()
+	get := func() string {
+		replies, err := r.pipeline([]redisCommand{newCommand("GET", "key")})
+		if err != nil {
+			t.Fatalf("Failed to get the key: %s", err)
+		}
+		reply, _ := redis.String(replies[0], nil)
+		return reply
+	}
+	set(a.addr(), a.addr(), "MOVED")
+	expect(get(), a.addr(), t)
+
+	// The slot moved to b without the client knowing
+	set(b.addr(), b.addr(), "MOVED")
+	expect(get(), b.addr(), t)
+	expect(r.node("key"), b.addr(), t)
+
+	// The slot is being migrated to a, which only answers when asked first
+	set(b.addr(), a.addr(), "ASK")
+	expect(get(), a.addr(), t)
+	expect(r.node("key"), b.addr(), t)
+
+	// b went down and a took over its slots
+	b.close()
+	set(a.addr(), a.addr(), "MOVED")
+	expect(get(), a.addr(), t)
+	expect(r.node("key"), a.addr(), t)
+}
+
+func TestRedisPending(t *testing.T) {
+
+	// Two feeds are still pending, one marked by another instance, and one
+	// was polled since
+	var mutex sync.Mutex
+	var forgotten []string
+	node := newFakeNode(func(node string, command []string, asking bool) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch strings.ToUpper(command[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "ZRANGEBYSCORE":
+			members := []string{"me http://example.com/lost", "other http://example.com/theirs", "me http://example.com/polled"}
+			reply := fmt.Sprintf("*%d\r\n", len(members))
+			for _, member := range members {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+			}
+			return reply
+		case "GET":
+			if command[1] == "feed:{http://example.com/polled}" {
+				return "$-1\r\n"
+			}
+			return "$4\r\ntrue\r\n"
+		case "ZREM":
+			forgotten = command[2:]
+			return fmt.Sprintf(":%d\r\n", len(forgotten))
+		}
+		return "-ERR unknown command\r\n"
+	}, t)
+	defer node.close()
+
+	c, err := NewRedisCache(RedisOptions{Server: node.addr(), Instance: "me"})
+	expect(err, nil, t)
+	defer c.Close()
+	instance, url := parsePendingMember(c.pendingMember("http://example.com/a b"))
+	expect(instance, "me", t)
+	expect(url, "http://example.com/a b", t)
+
+	pending, err := c.Pending(time.Now())
+	expect(err, nil, t)
+	expect(len(pending), 1, t)
+	expect(pending[0], "http://example.com/lost", t)
+	mutex.Lock()
+	defer mutex.Unlock()
+	expect(len(forgotten), 1, t)
+	expect(forgotten[0], "me http://example.com/polled", t)
+}
+
+func TestRedisPopularity(t *testing.T) {
+
+	// The scores were last decayed a half-life ago
+	var mutex sync.Mutex
+	var commands [][]string
+	halfLife := time.Hour
+	node := newFakeNode(func(node string, command []string, asking bool) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		commands = append(commands, command)
+		switch strings.ToUpper(command[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "ZINCRBY":
+			return "$1\r\n2\r\n"
+		case "GETSET":
+			decayed := strconv.FormatInt(time.Now().Add(-halfLife).UnixNano(), 10)
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(decayed), decayed)
+		case "ZUNIONSTORE", "ZREMRANGEBYSCORE", "ZREMRANGEBYRANK":
+			return ":1\r\n"
+		case "ZREVRANGE":
+			return "*4\r\n$1\r\na\r\n$1\r\n4\r\n$1\r\nb\r\n$3\r\n0.5\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	}, t)
+	defer node.close()
+
+	c, err := NewRedisCache(RedisOptions{Server: node.addr(), Prefix: "nimbus:"})
+	expect(err, nil, t)
+	defer c.Close()
+
+	scores, err := c.SharePopularity(map[string]float64{"a": 2}, halfLife, 10)
+	expect(err, nil, t)
+	expect(len(scores), 2, t)
+	expect(scores["a"], 4.0, t)
+	expect(scores["b"], 0.5, t)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sent := make(map[string][]string)
+	for _, command := range commands {
+		sent[command[0]] = command
+	}
+	expect(strings.Join(sent["ZINCRBY"], " "), "ZINCRBY nimbus:popularity 2 a", t)
+	weight, _ := strconv.ParseFloat(sent["ZUNIONSTORE"][5], 64)
+	expect(weight > 0.49 && weight < 0.51, true, t)
+	expect(strings.Join(sent["ZREMRANGEBYRANK"], " "), "ZREMRANGEBYRANK nimbus:popularity 0 -11", t)
+}
+
+func TestRedisRefreshes(t *testing.T) {
+
+	var mutex sync.Mutex
+	counts := make(map[string]int)
+	node := newFakeNode(func(node string, command []string, asking bool) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch strings.ToUpper(command[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "SET":
+			if _, exists := counts[command[1]]; exists {
+				return "$-1\r\n"
+			}
+			counts[command[1]] = 0
+			return "+OK\r\n"
+		case "INCRBY", "DECRBY":
+			by, _ := strconv.Atoi(command[2])
+			if command[0] == "DECRBY" {
+				by = -by
+			}
+			counts[command[1]] += by
+			return fmt.Sprintf(":%d\r\n", counts[command[1]])
+		}
+		return "-ERR unknown command\r\n"
+	}, t)
+	defer node.close()
+
+	c, err := NewRedisCache(RedisOptions{Server: node.addr()})
+	expect(err, nil, t)
+	defer c.Close()
+
+	allowed, err := c.CountRefreshes("10.0.0.1", 15, 20, 60)
+	expect(err, nil, t)
+	expect(allowed, true, t)
+	allowed, _ = c.CountRefreshes("10.0.0.1", 10, 20, 60)
+	expect(allowed, false, t)
+	allowed, _ = c.CountRefreshes("10.0.0.1", 5, 20, 60)
+	expect(allowed, true, t)
+	allowed, _ = c.CountRefreshes("10.0.0.2", 20, 20, 60)
+	expect(allowed, true, t)
+}
+
+func TestClusterLostReplies(t *testing.T) {
+
+	// The reply to the first GET is lost, and to the first SET when asked to
+	var mutex sync.Mutex
+	var node string
+	ran := make(map[string]int)
+	lose := false
+	answer := func(addr string, command []string, asking bool) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		name := strings.ToUpper(command[0])
+		ran[name]++
+		switch name {
+		case "PING":
+			return "+PONG\r\n"
+		case "CLUSTER":
+			host, port, _ := net.SplitHostPort(node)
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", clusterSlots-1, len(host), host, port)
+		case "GET":
+			if ran[name] == 1 {
+				return ""
+			}
+			return "$5\r\nvalue\r\n"
+		case "SET":
+			if lose {
+				return ""
+			}
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	}
+	a := newFakeNode(answer, t)
+	defer a.close()
+	mutex.Lock()
+	node = a.addr()
+	mutex.Unlock()
+
+	r := newClusterRedis([]string{a.addr()})
+	defer r.close()
+	count := func(name string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ran[name]
+	}
+
+	// Only the GET that went unanswered is sent again
+	replies, err := r.pipeline([]redisCommand{
+		newCommand("SET", "marker", "1", "NX"),
+		newCommand("GET", "key"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to run the commands: %s", err)
+	}
+	set, _ := redis.String(replies[0], nil)
+	get, _ := redis.String(replies[1], nil)
+	expect(set, "OK", t)
+	expect(get, "value", t)
+	expect(count("SET"), 1, t)
+	expect(count("GET"), 2, t)
+
+	// A SET NX may have run before its reply was lost, so it isn't sent again
+	mutex.Lock()
+	lose = true
+	mutex.Unlock()
+	if _, err := r.pipeline([]redisCommand{newCommand("SET", "marker", "1", "NX")}); err == nil {
+		t.Errorf("Expected the lost reply to fail the command")
+	}
+	expect(count("SET"), 2, t)
+
+	// A plain SET is
+	r.pipeline([]redisCommand{newCommand("SET", "key", "value")})
+	expect(count("SET"), 4, t)
+}
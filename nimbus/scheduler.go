@@ -0,0 +1,251 @@
+package nimbus
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("Queue is full")
+
+// Scheduler owns the set of pending feeds, the queue they wait in and the
+// workers polling them. A feed is pending from when it is enqueued until its
+// poll has finished, and claimed in the queue from when a worker pops it until
+// then, so it is never polled by two workers at once.
+type Scheduler struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+	active  map[string]bool
+	refresh map[string]bool
+	waiters map[string][]chan error
+	again   map[string][]chan error // Waiting for a poll after the one in flight
+	queue   *Queue
+	workers int
+	poll    func(url string, refresh bool) error
+	started bool
+	done    sync.WaitGroup
+	stats   SchedulerStats
+}
+
+type SchedulerStats struct {
+	Pending  int `json:"pending"`
+	Queued   int `json:"queued"`
+	Active   int `json:"active"`
+	Polled   int `json:"polled"`
+	Rejected int `json:"rejected"`
+	Evicted  int `json:"evicted"`
+}
+
+// NewScheduler makes a scheduler calling poll for every feed it polls. Feeds
+// polled on request from Refresh are polled with refresh set.
+func NewScheduler(workers int, limit int, weight func(string) float64, poll func(url string, refresh bool) error) *Scheduler {
+	return &Scheduler{
+		pending: make(map[string]bool),
+		active:  make(map[string]bool),
+		refresh: make(map[string]bool),
+		waiters: make(map[string][]chan error),
+		again:   make(map[string][]chan error),
+		queue:   NewQueue(limit, weight),
+		workers: workers,
+		poll:    poll,
+	}
+}
+
+// Enqueue schedules a feed to be polled, returning false if the queue is full
+// of feeds with higher priority.
+func (s *Scheduler) Enqueue(url string, due time.Time) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending[url] {
+		return true
+	}
+	evicted, ok := s.queue.Push(url, due)
+	if !ok {
+		s.stats.Rejected++
+		return false
+	}
+	if evicted != "" {
+		delete(s.pending, evicted)
+		s.stats.Evicted++
+	}
+	s.pending[url] = true
+	return true
+}
+
+// Request schedules a feed somebody is waiting for ahead of feeds that are
+// merely due, returning false if the queue is full of feeds with higher
+// priority. A feed that is already queued is moved ahead, and one being
+// polled is left to that poll.
+func (s *Scheduler) Request(url string) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	evicted, ok := s.queue.Request(url)
+	if !ok && s.queue.Claimed(url) {
+		return true
+	}
+	if !ok {
+		s.stats.Rejected++
+		return false
+	}
+	if evicted != "" {
+		delete(s.pending, evicted)
+		s.stats.Evicted++
+	}
+	s.pending[url] = true
+	return true
+}
+
+// Refresh polls a feed ahead of everything else. The returned channel receives
+// the result of the poll, or an error right away if it could not be queued. A
+// feed that is already being polled is polled again once that poll is done,
+// as it may have been fetched before it changed.
+func (s *Scheduler) Refresh(url string) <-chan error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	done := make(chan error, 1)
+
+	switch s.urgent(url) {
+	case nil:
+		s.waiters[url] = append(s.waiters[url], done)
+	case errClaimed:
+		s.again[url] = append(s.again[url], done)
+	default:
+		done <- ErrQueueFull
+	}
+	return done
+}
+
+// errClaimed is returned for feeds that are being polled.
+var errClaimed = errors.New("Feed is being polled")
+
+// urgent queues a feed to be refreshed, failing if it could not. A feed
+// popped by a worker stays claimed until the worker releases it holding the
+// lock of the scheduler, so it is still claimed after it was rejected.
+func (s *Scheduler) urgent(url string) error {
+	evicted, ok := s.queue.Urgent(url)
+	if !ok && s.queue.Claimed(url) {
+		return errClaimed
+	}
+	if !ok {
+		s.stats.Rejected++
+		return ErrQueueFull
+	}
+	if evicted != "" {
+		delete(s.pending, evicted)
+		s.stats.Evicted++
+	}
+	s.pending[url] = true
+	s.refresh[url] = true
+	return nil
+}
+
+// Scheduled tells if a feed is queued or being polled.
+func (s *Scheduler) Scheduled(url string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pending[url]
+}
+
+func (s *Scheduler) Start() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+	s.done.Add(s.workers)
+	for i := 0; i < s.workers; i++ {
+		go s.work()
+	}
+}
+
+// Stop lets the workers finish their current polls, waiting at most timeout
+// for them to do so. It returns the feeds that were still pending, either
+// waiting in the queue or not done polling when the timeout expired.
+func (s *Scheduler) Stop(timeout time.Duration) []string {
+
+	s.queue.Close()
+
+	stopped := make(chan bool)
+	go func() {
+		s.done.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	urls := make([]string, 0, len(s.pending))
+	for url := range s.pending {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// Wait blocks until every worker has exited after Stop, however long their
+// last polls take.
+func (s *Scheduler) Wait() {
+	s.done.Wait()
+}
+
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Pending = len(s.pending)
+	stats.Queued = s.queue.Len()
+	stats.Active = len(s.active)
+	return stats
+}
+
+func (s *Scheduler) work() {
+
+	defer s.done.Done()
+
+	for {
+		url, ok := s.queue.Pop()
+		if !ok {
+			return
+		}
+
+		s.mutex.Lock()
+		s.active[url] = true
+		refresh := s.refresh[url]
+		delete(s.refresh, url)
+		s.mutex.Unlock()
+
+		err := s.poll(url, refresh)
+
+		s.mutex.Lock()
+		s.stats.Polled++
+		s.queue.Release(url)
+		delete(s.active, url)
+		delete(s.pending, url)
+		for _, done := range s.waiters[url] {
+			done <- err
+		}
+		delete(s.waiters, url)
+		if again := s.again[url]; len(again) > 0 {
+			delete(s.again, url)
+			if s.urgent(url) == nil {
+				s.waiters[url] = again
+			} else {
+				for _, done := range again {
+					done <- ErrQueueFull
+				}
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,196 @@
+package nimbus
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerConcurrency(t *testing.T) {
+
+	var mutex sync.Mutex
+	active := make(map[string]bool)
+	polls := 0
+
+	poll := func(url string, refresh bool) error {
+		mutex.Lock()
+		if active[url] {
+			t.Errorf("Feed %s polled twice at once", url)
+		}
+		active[url] = true
+		polls++
+		mutex.Unlock()
+
+		time.Sleep(time.Microsecond)
+
+		mutex.Lock()
+		delete(active, url)
+		mutex.Unlock()
+		return nil
+	}
+
+	p := NewPopularity(time.Hour, 100)
+	s := NewScheduler(16, 50, p.Weight, poll)
+	s.Start()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			for j := 0; j < 500; j++ {
+				url := fmt.Sprintf("http://example.com/%d", (i*j)%100)
+				p.Hit(url, fmt.Sprint(i))
+				s.Enqueue(url, time.Now().Add(-time.Duration(j)*time.Second))
+				s.Stats()
+			}
+		}(i)
+	}
+	clients.Wait()
+
+	for s.Stats().Pending > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	expect(len(s.Stop(time.Second)), 0, t)
+
+	stats := s.Stats()
+	expect(stats.Active, 0, t)
+	expect(stats.Queued, 0, t)
+	expect(stats.Polled, polls, t)
+	expect(stats.Polled+stats.Rejected+stats.Evicted <= 32*500, true, t)
+}
+
+func TestSchedulerPending(t *testing.T) {
+
+	release := make(chan bool)
+	s := NewScheduler(1, 10, func(string) float64 { return 1 }, func(string, bool) error {
+		<-release
+		return nil
+	})
+
+	expect(s.Enqueue("a", time.Now()), true, t)
+	expect(s.Enqueue("a", time.Now()), true, t)
+	expect(s.Stats().Queued, 1, t)
+
+	s.Start()
+	for s.Stats().Active == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	expect(s.Enqueue("a", time.Now()), true, t)
+	expect(s.Stats().Queued, 0, t)
+	expect(s.Stats().Pending, 1, t)
+
+	release <- true
+	expect(len(s.Stop(time.Second)), 0, t)
+	expect(s.Stats().Pending, 0, t)
+	expect(s.Stats().Polled, 1, t)
+}
+
+func TestSchedulerStop(t *testing.T) {
+
+	release := make(chan bool)
+	s := NewScheduler(1, 10, func(string) float64 { return 1 }, func(string, bool) error {
+		<-release
+		return nil
+	})
+	s.Enqueue("a", time.Now().Add(-time.Hour))
+	s.Enqueue("b", time.Now())
+	s.Start()
+	for s.Stats().Active == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The poll of a is still in flight when the timeout expires
+	expect(len(s.Stop(time.Millisecond)), 2, t)
+	expect(s.Enqueue("c", time.Now()), false, t)
+	expect(s.Scheduled("a"), true, t)
+	expect(s.Scheduled("c"), false, t)
+
+	release <- true
+	for s.Stats().Pending > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	expect(s.Stop(time.Second)[0], "b", t)
+	s.Wait()
+	expect(s.Stats().Active, 0, t)
+}
+
+func TestSchedulerRefresh(t *testing.T) {
+
+	var polled []string
+	release := make(chan bool)
+	s := NewScheduler(1, 20, func(string) float64 { return 1 }, func(url string, refresh bool) error {
+		<-release
+		polled = append(polled, fmt.Sprintf("%s:%t", url, refresh))
+		return fmt.Errorf("%s failed", url)
+	})
+	s.Enqueue("a", time.Now().Add(-time.Hour))
+	s.Enqueue("b", time.Now().Add(-time.Hour))
+	s.Start()
+	for s.Stats().Active == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The poll of a in flight may have fetched it before it changed
+	waiting := s.Refresh("a")
+	refreshed := s.Refresh("c")
+	release <- true
+	release <- true
+	expect((<-refreshed).Error(), "c failed", t)
+	release <- true
+	expect((<-waiting).Error(), "a failed", t)
+	release <- true
+
+	s.Stop(time.Second)
+	expect(fmt.Sprint(polled), fmt.Sprint([]string{"a:false", "c:true", "a:true", "b:false"}), t)
+}
+
+func TestSchedulerRequestRefresh(t *testing.T) {
+
+	var mutex sync.Mutex
+	active, most := 0, 0
+	poll := func(url string, refresh bool) error {
+		mutex.Lock()
+		active++
+		if active > most {
+			most = active
+		}
+		mutex.Unlock()
+
+		runtime.Gosched()
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		return nil
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	s := NewScheduler(8, 50, func(string) float64 { return 1 }, poll)
+	s.Start()
+
+	// Requests and refreshes race with the busy workers popping the feed
+	var clients sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			for j := 0; j < 2000; j++ {
+				if i%2 == 0 {
+					s.Request("a")
+				} else {
+					s.Refresh("a")
+				}
+			}
+		}(i)
+	}
+	clients.Wait()
+
+	for s.Stats().Pending > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	expect(len(s.Stop(time.Second)), 0, t)
+	expect(most, 1, t)
+}
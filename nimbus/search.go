@@ -0,0 +1,50 @@
+package nimbus
+
+import (
+	"strings"
+	"time"
+)
+
+// SearchQuery finds the items matching Text, published between From and To
+// and in any of Feeds, by url or alias. Zero fields leave the search open.
+type SearchQuery struct {
+	Text   string    `json:"query"`
+	Feeds  []string  `json:"feeds"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+// SearchResult is an item found by a search, ranked by how well it matched.
+type SearchResult struct {
+	Item
+	Feed string  `json:"feed"`
+	Rank float64 `json:"rank"`
+}
+
+// searchTerms splits text into lower case words, for stores without full
+// text search of their own.
+func searchTerms(text string) []string {
+	return strings.Fields(strings.ToLower(text))
+}
+
+// searchRank counts the terms found in an item, weighing its title double.
+// Items missing any of the terms are not found at all.
+func searchRank(item *Item, terms []string) float64 {
+	title, teaser := strings.ToLower(item.Title), strings.ToLower(item.Teaser)
+	rank := 0.0
+	for _, term := range terms {
+		inTitle, inTeaser := strings.Contains(title, term), strings.Contains(teaser, term)
+		if !inTitle && !inTeaser {
+			return 0
+		}
+		if inTitle {
+			rank += 2
+		}
+		if inTeaser {
+			rank++
+		}
+	}
+	return rank
+}
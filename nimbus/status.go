@@ -0,0 +1,75 @@
+package nimbus
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusPending = "pending"
+	StatusInvalid = "invalid"
+	StatusGone    = "gone"
+	StatusError   = "error"
+)
+
+// Status tells what became of a requested feed. The feed is included whenever
+// it has been fetched before, even if its latest poll failed.
+type Status struct {
+	Status    string           `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	FetchedAt *time.Time       `json:"fetched_at,omitempty"`
+	RetryAt   *time.Time       `json:"retry_at,omitempty"`
+	Alias     string           `json:"alias,omitempty"`
+	Feed      *json.RawMessage `json:"feed,omitempty"`
+}
+
+// Failure tells why a feed that was never fetched could not be, and when it
+// will be tried again.
+type Failure struct {
+	Error   string    `json:"error"`
+	Gone    bool      `json:"gone"`
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// NewStatus makes the status of a feed requested by url from its cached value,
+// and the failure of the feed if it is invalid. Alias is the url of the feed
+// the requested url resolved to, if it differs.
+func NewStatus(url string, value *json.RawMessage, failure *Failure) *Status {
+
+	switch string(*value) {
+	case pendingMarker:
+		return &Status{Status: StatusPending}
+	case invalidMarker:
+		status := &Status{Status: StatusInvalid}
+		if failure != nil {
+			if failure.Gone {
+				status.Status = StatusGone
+			}
+			status.Error = failure.Error
+			status.RetryAt = &failure.RetryAt
+		}
+		return status
+	}
+
+	var feed Feed
+	if err := json.Unmarshal(*value, &feed); err != nil {
+		return &Status{Status: StatusError, Error: "Unable to read feed: " + err.Error()}
+	}
+	status := &Status{Status: StatusOK, Feed: value}
+	if !feed.FetchedAt.IsZero() {
+		status.FetchedAt = &feed.FetchedAt
+	}
+	if feed.URL != url {
+		status.Alias = feed.URL
+	}
+	if feed.LastError != "" {
+		status.Status = StatusError
+		if feed.Gone {
+			status.Status = StatusGone
+		}
+		status.Error = feed.LastError
+		status.RetryAt = &feed.NextPollAt
+	}
+	return status
+}
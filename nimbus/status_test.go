@@ -0,0 +1,45 @@
+package nimbus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func raw(value string) *json.RawMessage {
+	rm := json.RawMessage(value)
+	return &rm
+}
+
+func TestNewStatus(t *testing.T) {
+
+	status := NewStatus("http://example.com", raw("true"), nil)
+	expect(status.Status, StatusPending, t)
+
+	status = NewStatus("http://example.com", raw("false"), nil)
+	expect(status.Status, StatusInvalid, t)
+	retry := time.Now().Add(time.Hour)
+	status = NewStatus("http://example.com", raw("false"), &Failure{Error: "Feed is gone: 410 Gone", Gone: true, RetryAt: retry})
+	expect(status.Status, StatusGone, t)
+	expect(status.Error, "Feed is gone: 410 Gone", t)
+	expect(*status.RetryAt, retry, t)
+
+	fetched := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	feed, _ := json.Marshal(&Feed{URL: "http://xkcd.com/rss.xml", FetchedAt: fetched})
+	status = NewStatus("http://xkcd.com/atom.xml", raw(string(feed)), nil)
+	expect(status.Status, StatusOK, t)
+	expect(status.Alias, "http://xkcd.com/rss.xml", t)
+	expect(status.FetchedAt.Equal(fetched), true, t)
+	expect(status.RetryAt == nil, true, t)
+	expect(string(*status.Feed), string(feed), t)
+
+	feed, _ = json.Marshal(&Feed{URL: "http://xkcd.com/rss.xml", FetchedAt: fetched, NextPollAt: retry, LastError: "Timeout"})
+	status = NewStatus("http://xkcd.com/rss.xml", raw(string(feed)), nil)
+	expect(status.Status, StatusError, t)
+	expect(status.Alias, "", t)
+	expect(status.Error, "Timeout", t)
+	expect(status.RetryAt.Unix(), retry.Unix(), t)
+
+	status = NewStatus("http://example.com", raw("{"), nil)
+	expect(status.Status, StatusError, t)
+}
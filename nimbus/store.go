@@ -0,0 +1,118 @@
+package nimbus
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("Not found")
+
+// Store keeps feeds, their items and aliases between polls, and answers the
+// queries used to schedule polls.
+type Store interface {
+
+	// Feed returns the feed without its items, or ErrNotFound.
+	Feed(url string) (*Feed, error)
+	// DuplicateCandidates returns up to limit other feeds, oldest first and
+	// without their items, that link to the same site as the feed or share a
+	// sampled item with it by guid or link. Links are compared normalized.
+	DuplicateCandidates(feed *Feed, limit int) ([]Feed, error)
+	// SaveFeed creates the feed, or updates it if it has an ID, and upserts its
+	// items by guid, all in a single transaction. Items whose title, teaser or
+	// url changed get a revision keeping what they said before. Before the feed
+	// itself is written observe is called, if given, with the number of items
+	// that were not stored before.
+	SaveFeed(feed *Feed, observe func(found int)) error
+	// UpdateFeed saves the feed itself, leaving its items untouched.
+	UpdateFeed(feed *Feed) error
+	// DeleteFeed deletes the feed, its items and the aliases pointing to it.
+	DeleteFeed(feed *Feed) error
+	// FeedURLs returns the urls of all feeds that are not dormant.
+	FeedURLs() ([]string, error)
+
+	// Items returns up to limit of the newest items of a feed, or all of them
+	// if limit is zero.
+	Items(feedID int, limit int) ([]Item, error)
+	// Item returns the item of a feed with the given guid, or ErrNotFound.
+	Item(feedID int, guid string) (*Item, error)
+	// Revisions returns what an item said before each change, newest first.
+	Revisions(itemID int) ([]Revision, error)
+	// Search returns a page of the items matching the query, best match first.
+	Search(query SearchQuery) ([]SearchResult, error)
+	// StarItem stars or unstars the item of a feed with the given guid, or
+	// returns ErrNotFound.
+	StarItem(feedID int, guid string, starred bool) error
+	// PruneItems deletes up to limit items of the feed that the retention
+	// policy does not keep, returning how many were deleted.
+	PruneItems(feed *Feed, retention Retention, limit int) (int, error)
+
+	// CreateAlias creates the alias, replacing any alias of the same url, and
+	// points it at the end of the chain of its original. Aliases of the alias
+	// are pointed there too. ErrAliasCycle is returned if the original leads
+	// back to the alias.
+	CreateAlias(alias *Alias) error
+	// Aliases returns every alias, unaliased ones included.
+	Aliases() ([]Alias, error)
+	// Alias returns the alias of a url, or ErrNotFound.
+	Alias(url string) (*Alias, error)
+	// DeleteAlias deletes the alias of a url, or returns ErrNotFound.
+	DeleteAlias(url string) error
+	// Unalias undoes the alias of a url, keeping it as unaliased, or returns
+	// ErrNotFound.
+	Unalias(url string) error
+	// Original returns the url of the feed at the end of the chain of aliases
+	// from a url, pointing the aliases on the way straight at it. ErrNotFound
+	// is returned if the url is not an alias and ErrAliasCycle if the chain
+	// leads back to it. Unaliased aliases are not followed.
+	Original(alias string) (string, error)
+
+	// DueFeeds returns the url and next poll of feeds due before the given
+	// time, leaving out dormant feeds.
+	DueFeeds(before time.Time) ([]Feed, error)
+	// Reschedule moves the next poll of the given feeds.
+	Reschedule(urls []string, at time.Time) error
+	// MarkRequested records that the given feeds were requested, which revives
+	// those that are dormant.
+	MarkRequested(urls []string, at time.Time) error
+	// MarkDormant makes feeds not requested since the given time dormant,
+	// returning their urls. A feed requested meanwhile is left alone.
+	MarkDormant(before time.Time) ([]string, error)
+
+	Close() error
+}
+
+// Retention decides which items are kept. An item is kept if it is among the
+// newest Keep items of its feed, if it was published within MaxAge or if it is
+// starred. Leaving Keep or MaxAge at zero keeps every item by that measure.
+// Items the feed still references are kept regardless: the newest Floor items,
+// which are the ones served, and as many of the newest as the feed listed when
+// it was last saved.
+type Retention struct {
+	Keep   int
+	MaxAge time.Duration
+	Floor  int
+}
+
+// Enabled tells if the policy would prune any items at all.
+func (r Retention) Enabled() bool {
+	return r.Keep > 0 || r.MaxAge > 0
+}
+
+// kept returns how many of the newest items of a feed are kept by rank alone.
+func (r Retention) kept(feed *Feed) int {
+	return maxInt(r.Keep, maxInt(r.Floor, feed.Listed))
+}
+
+// uniqueItems drops items repeating the guid of an earlier item, which would
+// otherwise be upserted twice.
+func uniqueItems(items []Item) []Item {
+	seen := make(map[string]bool, len(items))
+	unique := make([]Item, 0, len(items))
+	for _, item := range items {
+		if !seen[item.GUID] {
+			seen[item.GUID] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
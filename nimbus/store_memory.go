@@ -0,0 +1,499 @@
+package nimbus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps feeds in memory, for tests and for running without a
+// database. Nothing survives a restart.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	lastID    int
+	feeds     map[string]*Feed
+	items     map[int][]*Item
+	revisions map[int][]Revision
+	aliases   []Alias
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		feeds:     make(map[string]*Feed),
+		items:     make(map[int][]*Item),
+		revisions: make(map[int][]Revision),
+	}
+}
+
+func (s *MemoryStore) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *MemoryStore) Feed(url string) (*Feed, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if feed, exists := s.feeds[url]; exists {
+		copied := *feed
+		return &copied, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) DuplicateCandidates(feed *Feed, limit int) ([]Feed, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	guids, links := sampleKeys(feed.Items)
+	sampled := make(map[string]bool)
+	for _, guid := range guids {
+		sampled["guid:"+guid] = true
+	}
+	for _, link := range links {
+		sampled["link:"+link] = true
+	}
+
+	var feeds []Feed
+	for url, candidate := range s.feeds {
+		if url == feed.URL {
+			continue
+		}
+		shares := feed.Link != "" && candidate.LinkKey == normalizeLink(feed.Link)
+		for _, item := range s.items[candidate.ID] {
+			shares = shares || sampled["guid:"+item.GUID] || sampled["link:"+item.LinkKey]
+		}
+		if shares {
+			feeds = append(feeds, *candidate)
+		}
+	}
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].ID < feeds[j].ID
+	})
+	if len(feeds) > limit {
+		feeds = feeds[:limit]
+	}
+	return feeds, nil
+}
+
+func (s *MemoryStore) SaveFeed(feed *Feed, observe func(found int)) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	createdAt := time.Now()
+	if feed.ID != 0 {
+		previous, exists := s.feeds[feed.URL]
+		if !exists || previous.ID != feed.ID {
+			return ErrNotFound
+		}
+		createdAt = previous.CreatedAt
+	}
+
+	items := uniqueItems(feed.Items)
+	keyLinks(feed, items)
+	feed.Listed = len(items)
+	stored := make(map[string]*Item)
+	for _, item := range s.items[feed.ID] {
+		stored[item.GUID] = item
+	}
+	found := 0
+	for _, item := range items {
+		if _, exists := stored[item.GUID]; !exists {
+			found++
+		}
+	}
+	if observe != nil {
+		observe(found)
+	}
+
+	now := time.Now()
+	saved := *feed
+	saved.Items = nil
+	saved.CreatedAt = createdAt
+	saved.UpdatedAt = now
+	if saved.ID == 0 {
+		saved.ID = s.nextID()
+	}
+	s.feeds[feed.URL] = &saved
+
+	for _, item := range items {
+		if existing, exists := stored[item.GUID]; exists {
+			if revision := existing.revise(item, now); revision != nil {
+				revision.ID = s.nextID()
+				s.revisions[existing.ID] = append(s.revisions[existing.ID], *revision)
+			}
+			existing.LinkKey = item.LinkKey
+			continue
+		}
+		created := item
+		created.ID = s.nextID()
+		created.FeedID = saved.ID
+		created.CreatedAt = now
+		created.UpdatedAt = now
+		s.items[saved.ID] = append(s.items[saved.ID], &created)
+	}
+
+	feed.ID = saved.ID
+	feed.CreatedAt = saved.CreatedAt
+	feed.UpdatedAt = saved.UpdatedAt
+	feed.Items = items
+	return nil
+}
+
+func (s *MemoryStore) UpdateFeed(feed *Feed) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.feeds[feed.URL]
+	if !exists || stored.ID != feed.ID {
+		return ErrNotFound
+	}
+	feed.LinkKey = normalizeLink(feed.Link)
+	updated := *feed
+	updated.Items = nil
+	updated.CreatedAt = stored.CreatedAt
+	updated.UpdatedAt = time.Now()
+	s.feeds[feed.URL] = &updated
+	return nil
+}
+
+func (s *MemoryStore) DeleteFeed(feed *Feed) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	aliases := s.aliases[:0]
+	for _, alias := range s.aliases {
+		if alias.Original != feed.URL {
+			aliases = append(aliases, alias)
+		}
+	}
+	s.aliases = aliases
+
+	for _, item := range s.items[feed.ID] {
+		delete(s.revisions, item.ID)
+	}
+	delete(s.items, feed.ID)
+	delete(s.feeds, feed.URL)
+	return nil
+}
+
+func (s *MemoryStore) FeedURLs() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	urls := make([]string, 0, len(s.feeds))
+	for url, feed := range s.feeds {
+		if !feed.Dormant {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+func (s *MemoryStore) Items(feedID int, limit int) ([]Item, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	items := make([]Item, len(s.items[feedID]))
+	for i, item := range s.items[feedID] {
+		items[i] = *item
+		items[i].Updated = item.UpdatedAt.After(item.CreatedAt)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].PublishedAt.After(items[j].PublishedAt)
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) Item(feedID int, guid string) (*Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, item := range s.items[feedID] {
+		if item.GUID == guid {
+			copied := *item
+			copied.Updated = item.UpdatedAt.After(item.CreatedAt)
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) Revisions(itemID int) ([]Revision, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	revisions := make([]Revision, len(s.revisions[itemID]))
+	for i, revision := range s.revisions[itemID] {
+		revisions[len(revisions)-1-i] = revision
+	}
+	return revisions, nil
+}
+
+func (s *MemoryStore) Search(query SearchQuery) ([]SearchResult, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	scope := make(map[string]bool)
+	for _, url := range query.Feeds {
+		scope[url] = true
+	}
+	for _, alias := range s.aliases {
+		if scope[alias.Alias] && !alias.Unaliased {
+			scope[alias.Original] = true
+		}
+	}
+
+	results := make([]SearchResult, 0)
+	for url, feed := range s.feeds {
+		if len(scope) > 0 && !scope[url] {
+			continue
+		}
+		for _, item := range s.items[feed.ID] {
+			if !query.From.IsZero() && item.PublishedAt.Before(query.From) {
+				continue
+			}
+			if !query.To.IsZero() && !item.PublishedAt.Before(query.To) {
+				continue
+			}
+			if rank := searchRank(item, terms); rank > 0 {
+				result := SearchResult{Item: *item, Feed: url, Rank: rank}
+				result.Updated = item.UpdatedAt.After(item.CreatedAt)
+				results = append(results, result)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		if !results[i].PublishedAt.Equal(results[j].PublishedAt) {
+			return results[i].PublishedAt.After(results[j].PublishedAt)
+		}
+		return results[i].ID > results[j].ID
+	})
+	if query.Offset >= len(results) {
+		return results[:0], nil
+	}
+	results = results[query.Offset:]
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) StarItem(feedID int, guid string, starred bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, item := range s.items[feedID] {
+		if item.GUID == guid {
+			item.Starred = starred
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) PruneItems(feed *Feed, retention Retention, limit int) (int, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !retention.Enabled() {
+		return 0, nil
+	}
+
+	items := s.items[feed.ID]
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].PublishedAt.Equal(items[j].PublishedAt) {
+			return items[i].ID > items[j].ID
+		}
+		return items[i].PublishedAt.After(items[j].PublishedAt)
+	})
+
+	pruned := 0
+	rankKept := retention.kept(feed)
+	cutoff := time.Now().Add(-retention.MaxAge)
+	kept := items[:0]
+	for rank, item := range items {
+		if pruned >= limit ||
+			item.Starred ||
+			rank < rankKept ||
+			(retention.MaxAge > 0 && !item.PublishedAt.Before(cutoff)) {
+			kept = append(kept, item)
+			continue
+		}
+		delete(s.revisions, item.ID)
+		pruned++
+	}
+	s.items[feed.ID] = kept
+	return pruned, nil
+}
+
+func (s *MemoryStore) CreateAlias(alias *Alias) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if alias.Alias == "" || alias.Original == "" {
+		return fmt.Errorf("Alias and original must both be given")
+	}
+	original, _, err := resolveAlias(alias.Original, s.lookupAlias)
+	if err == nil {
+		alias.Original = original
+	} else if err != ErrNotFound {
+		return err
+	}
+	if alias.Original == alias.Alias {
+		return ErrAliasCycle
+	}
+
+	if i := s.findAlias(alias.Alias); i >= 0 {
+		s.aliases = append(s.aliases[:i], s.aliases[i+1:]...)
+	}
+	for i := range s.aliases {
+		if s.aliases[i].Original == alias.Alias {
+			s.aliases[i].Original = alias.Original
+		}
+	}
+	alias.ID = s.nextID()
+	alias.Unaliased = false
+	alias.CreatedAt = time.Now()
+	s.aliases = append(s.aliases, *alias)
+	return nil
+}
+
+func (s *MemoryStore) Aliases() ([]Alias, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Alias(nil), s.aliases...), nil
+}
+
+func (s *MemoryStore) Alias(url string) (*Alias, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if i := s.findAlias(url); i >= 0 {
+		found := s.aliases[i]
+		return &found, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteAlias(url string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := s.findAlias(url)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.aliases = append(s.aliases[:i], s.aliases[i+1:]...)
+	return nil
+}
+
+func (s *MemoryStore) Unalias(url string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := s.findAlias(url)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.aliases[i].Unaliased = true
+	return nil
+}
+
+func (s *MemoryStore) Original(alias string) (string, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	original, hops, err := resolveAlias(alias, s.lookupAlias)
+	if err != nil {
+		return "", err
+	}
+	for _, hop := range hops {
+		s.aliases[s.findAlias(hop)].Original = original
+	}
+	return original, nil
+}
+
+// findAlias returns the index of the alias of a url, or -1.
+func (s *MemoryStore) findAlias(url string) int {
+	for i, alias := range s.aliases {
+		if alias.Alias == url {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupAlias returns what a url is an alias of, leaving out unaliased ones.
+func (s *MemoryStore) lookupAlias(url string) (string, error) {
+	if i := s.findAlias(url); i >= 0 && !s.aliases[i].Unaliased {
+		return s.aliases[i].Original, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *MemoryStore) DueFeeds(before time.Time) ([]Feed, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var feeds []Feed
+	for _, feed := range s.feeds {
+		if !feed.Dormant && feed.NextPollAt.Before(before) {
+			feeds = append(feeds, Feed{URL: feed.URL, NextPollAt: feed.NextPollAt})
+		}
+	}
+	return feeds, nil
+}
+
+func (s *MemoryStore) Reschedule(urls []string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, url := range urls {
+		if feed, exists := s.feeds[url]; exists {
+			feed.NextPollAt = at
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) MarkRequested(urls []string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, url := range urls {
+		if feed, exists := s.feeds[url]; exists {
+			feed.RequestedAt = at
+			feed.Dormant = false
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) MarkDormant(before time.Time) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var urls []string
+	for url, feed := range s.feeds {
+		if !feed.Dormant && feed.RequestedAt.Before(before) {
+			feed.Dormant = true
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,548 @@
+package nimbus
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+const upsertBatch = 100 // Items per statement, SQLite allows 999 parameters
+
+// SQLStore keeps feeds in a relational database through gorm.
+type SQLStore struct {
+	db          *gorm.DB
+	dialect     string
+	columnTypes *strings.Replacer
+}
+
+func NewPostgresStore(args string, maxConns int) (*SQLStore, error) {
+
+	db, err := gorm.Open("postgres", args)
+	if err != nil {
+		return nil, err
+	}
+
+	db.DB().SetMaxOpenConns(maxConns)
+	db.DB().SetMaxIdleConns(maxConns / 2)
+
+	return newSQLStore(&db, "postgres"), nil
+}
+
+// newSQLStore wraps an open database, which must be migrated before use.
+func newSQLStore(db *gorm.DB, dialect string) *SQLStore {
+	db.SingularTable(true)
+	return &SQLStore{db: db, dialect: dialect, columnTypes: columnTypes[dialect]}
+}
+
+func (s *SQLStore) first(where *Feed) (*Feed, error) {
+	var feed Feed
+	query := s.db.Where(where).First(&feed)
+	if query.RecordNotFound() {
+		return nil, ErrNotFound
+	}
+	return &feed, query.Error
+}
+
+func (s *SQLStore) Feed(url string) (*Feed, error) {
+	return s.first(&Feed{URL: url})
+}
+
+func (s *SQLStore) DuplicateCandidates(feed *Feed, limit int) ([]Feed, error) {
+
+	var conditions []string
+	var args []interface{}
+	if feed.Link != "" {
+		conditions = append(conditions, "link_key = ?")
+		args = append(args, normalizeLink(feed.Link))
+	}
+	guids, links := sampleKeys(feed.Items)
+	if len(guids) > 0 {
+		conditions = append(conditions, "id in (SELECT feed_id FROM item WHERE guid in (?))")
+		args = append(args, guids)
+	}
+	if len(links) > 0 {
+		conditions = append(conditions, "id in (SELECT feed_id FROM item WHERE link_key in (?))")
+		args = append(args, links)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	var feeds []Feed
+	args = append([]interface{}{feed.URL}, args...)
+	err := s.db.Where("url <> ? AND ("+strings.Join(conditions, " OR ")+")", args...).Order("id").Limit(limit).Find(&feeds).Error
+	return feeds, err
+}
+
+func (s *SQLStore) SaveFeed(feed *Feed, observe func(found int)) error {
+
+	items := uniqueItems(feed.Items)
+	keyLinks(feed, items)
+	feed.Listed = len(items)
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	stored := make(map[string]*Item)
+	if feed.ID != 0 {
+		for start := 0; start < len(items); start += upsertBatch {
+			batch := items[start:minInt(start+upsertBatch, len(items))]
+			guids := make([]string, len(batch))
+			for i, item := range batch {
+				guids[i] = item.GUID
+			}
+			var existing []Item
+			if err := tx.Where("feed_id = ? AND guid in (?)", feed.ID, guids).Find(&existing).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			for i := range existing {
+				stored[existing[i].GUID] = &existing[i]
+			}
+		}
+	}
+	if observe != nil {
+		observe(len(items) - len(stored))
+	}
+
+	feed.Items = nil
+	var err error
+	if feed.ID == 0 {
+		err = tx.Create(feed).Error
+	} else {
+		err = updateFeed(tx, feed)
+	}
+	feed.Items = items
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	for _, item := range items {
+		existing, exists := stored[item.GUID]
+		if !exists {
+			continue
+		}
+		if revision := existing.revise(item, now); revision != nil {
+			if err := tx.Create(revision).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	for start := 0; start < len(items); start += upsertBatch {
+		batch := items[start:minInt(start+upsertBatch, len(items))]
+		if err := s.upsertItems(tx, feed.ID, batch, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// upsertItems inserts new items and updates changed ones, leaving the rest as
+// they are. On postgres it also keeps their search vectors. Items keyed by
+// their link before it was normalized get the key without counting as updated.
+func (s *SQLStore) upsertItems(tx *gorm.DB, feedID int, items []Item, now time.Time) error {
+
+	changed := "item.title <> excluded.title OR item.teaser <> excluded.teaser OR item.url <> excluded.url"
+	columns := "feed_id, title, teaser, url, link_key, guid, published_at, starred, created_at, updated_at"
+	row := "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	updates := "title = excluded.title, teaser = excluded.teaser, url = excluded.url, link_key = excluded.link_key, " +
+		"updated_at = CASE WHEN " + changed + " THEN excluded.updated_at ELSE item.updated_at END"
+	if s.dialect == "postgres" {
+		columns += ", search"
+		row = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, " + searchVector("?::text", "?::text") + ")"
+		updates += ", search = excluded.search"
+	}
+
+	rows := make([]string, len(items))
+	args := make([]interface{}, 0, len(items)*12)
+	for i, item := range items {
+		rows[i] = row
+		args = append(args, feedID, item.Title, item.Teaser, item.URL, item.LinkKey, item.GUID, item.PublishedAt, item.Starred, now, now)
+		if s.dialect == "postgres" {
+			args = append(args, item.Title, item.Teaser)
+		}
+	}
+
+	query := fmt.Sprintf(`INSERT INTO item (%s)
+		VALUES %s
+		ON CONFLICT (feed_id, guid) DO UPDATE SET %s
+		WHERE %s OR item.link_key <> excluded.link_key`,
+		columns, strings.Join(rows, ", "), updates, changed)
+	return tx.Exec(query, args...).Error
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *SQLStore) UpdateFeed(feed *Feed) error {
+	feed.LinkKey = normalizeLink(feed.Link)
+	return updateFeed(s.db, feed)
+}
+
+// updateFeed saves a stored feed, which gorm would create if it was missing.
+func updateFeed(db *gorm.DB, feed *Feed) error {
+	var count int
+	if err := db.Model(&Feed{}).Where("id = ?", feed.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return db.Omit("Items", "CreatedAt").Save(feed).Error
+}
+
+func (s *SQLStore) DeleteFeed(feed *Feed) error {
+	if err := s.db.Where(&Alias{Original: feed.URL}).Delete(Alias{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where("item_id in (SELECT id FROM item WHERE feed_id = ?)", feed.ID).Delete(Revision{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where(&Item{FeedID: feed.ID}).Delete(Item{}).Error; err != nil {
+		return err
+	}
+	return s.db.Delete(feed).Error
+}
+
+func (s *SQLStore) FeedURLs() ([]string, error) {
+	var urls []string
+	err := s.db.Model(&Feed{}).Where("dormant = ?", false).Pluck("url", &urls).Error
+	return urls, err
+}
+
+func (s *SQLStore) Items(feedID int, limit int) ([]Item, error) {
+	var items []Item
+	query := s.db.Where(&Item{FeedID: feedID}).Order("published_at desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&items).Error
+	for i := range items {
+		items[i].Updated = items[i].UpdatedAt.After(items[i].CreatedAt)
+	}
+	return items, err
+}
+
+func (s *SQLStore) Item(feedID int, guid string) (*Item, error) {
+	var item Item
+	query := s.db.Where(&Item{FeedID: feedID, GUID: guid}).First(&item)
+	if query.RecordNotFound() {
+		return nil, ErrNotFound
+	}
+	item.Updated = item.UpdatedAt.After(item.CreatedAt)
+	return &item, query.Error
+}
+
+func (s *SQLStore) Revisions(itemID int) ([]Revision, error) {
+	var revisions []Revision
+	err := s.db.Where(&Revision{ItemID: itemID}).Order("created_at desc, id desc").Find(&revisions).Error
+	return revisions, err
+}
+
+func (s *SQLStore) Search(query SearchQuery) ([]SearchResult, error) {
+
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	rank := ""
+	if s.dialect == "postgres" {
+		rank = "ts_rank(item.search, plainto_tsquery('english', ?))"
+		args = append(args, query.Text)
+		conditions = append(conditions, "item.search @@ plainto_tsquery('english', ?)")
+		args = append(args, query.Text)
+	} else {
+		// Without full text search every term has to appear somewhere
+		ranks := make([]string, len(terms))
+		for i, term := range terms {
+			ranks[i] = `(CASE WHEN item.title LIKE ? ESCAPE '\' THEN 2 ELSE 0 END + CASE WHEN item.teaser LIKE ? ESCAPE '\' THEN 1 ELSE 0 END)`
+			pattern := "%" + likeEscaper.Replace(term) + "%"
+			args = append(args, pattern, pattern)
+		}
+		rank = strings.Join(ranks, " + ")
+		for _, term := range terms {
+			conditions = append(conditions, `(item.title LIKE ? ESCAPE '\' OR item.teaser LIKE ? ESCAPE '\')`)
+			pattern := "%" + likeEscaper.Replace(term) + "%"
+			args = append(args, pattern, pattern)
+		}
+	}
+	if len(query.Feeds) > 0 {
+		conditions = append(conditions, "(feed.url in (?) OR feed.url in (SELECT original FROM alias WHERE alias in (?) AND unaliased = ?))")
+		args = append(args, query.Feeds, query.Feeds, false)
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "item.published_at >= ?")
+		args = append(args, query.From)
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "item.published_at < ?")
+		args = append(args, query.To)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+		if s.dialect == "postgres" {
+			limit = math.MaxInt32
+		}
+	}
+	args = append(args, limit, query.Offset)
+
+	sql := fmt.Sprintf(`SELECT item.id, item.feed_id, item.title, item.teaser, item.url, item.guid,
+		item.published_at, item.starred, item.created_at, item.updated_at,
+		feed.url AS feed, %s AS rank
+		FROM item JOIN feed ON feed.id = item.feed_id
+		WHERE %s
+		ORDER BY rank DESC, item.published_at DESC, item.id DESC
+		LIMIT ? OFFSET ?`,
+		rank, strings.Join(conditions, " AND "))
+	results := make([]SearchResult, 0)
+	err := s.db.Raw(sql, args...).Scan(&results).Error
+	for i := range results {
+		results[i].Updated = results[i].UpdatedAt.After(results[i].CreatedAt)
+	}
+	return results, err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *SQLStore) StarItem(feedID int, guid string, starred bool) error {
+	query := s.db.Model(&Item{}).Where("feed_id = ? AND guid = ?", feedID, guid).UpdateColumn("starred", starred)
+	if query.Error == nil && query.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return query.Error
+}
+
+func (s *SQLStore) PruneItems(feed *Feed, retention Retention, limit int) (int, error) {
+
+	if !retention.Enabled() {
+		return 0, nil
+	}
+
+	conditions := []string{"starred = ?", "recency > ?"}
+	args := []interface{}{feed.ID, false, retention.kept(feed)}
+	if retention.MaxAge > 0 {
+		conditions = append(conditions, "published_at < ?")
+		args = append(args, time.Now().Add(-retention.MaxAge))
+	}
+	args = append(args, limit)
+
+	// Each call deletes a single batch of a single feed, so neither the ranking
+	// nor the deletion hold the table for long
+	query := fmt.Sprintf(`SELECT id FROM (
+			SELECT id, starred, published_at,
+			ROW_NUMBER() OVER (ORDER BY published_at DESC, id DESC) AS recency
+			FROM item WHERE feed_id = ?
+		) ranked WHERE %s LIMIT ?`,
+		strings.Join(conditions, " AND "))
+	var ids []int
+	rows, err := s.db.Raw(query, args...).Rows()
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	if err = tx.Where("item_id in (?)", ids).Delete(Revision{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Where("id in (?)", ids).Delete(Item{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(ids), tx.Commit().Error
+}
+
+func (s *SQLStore) CreateAlias(alias *Alias) error {
+
+	if alias.Alias == "" || alias.Original == "" {
+		return fmt.Errorf("Alias and original must both be given")
+	}
+	original, _, err := resolveAlias(alias.Original, s.lookupAlias)
+	switch err {
+	case nil:
+		alias.Original = original
+	case ErrNotFound:
+	default:
+		return err
+	}
+	if alias.Original == alias.Alias {
+		return ErrAliasCycle
+	}
+	alias.Unaliased = false
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Where(&Alias{Alias: alias.Alias}).Delete(Alias{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(alias).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(&Alias{}).Where("original = ?", alias.Alias).UpdateColumn("original", alias.Original).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *SQLStore) Aliases() ([]Alias, error) {
+	var aliases []Alias
+	err := s.db.Find(&aliases).Error
+	return aliases, err
+}
+
+func (s *SQLStore) Alias(url string) (*Alias, error) {
+	var found Alias
+	query := s.db.Where(&Alias{Alias: url}).First(&found)
+	if query.RecordNotFound() {
+		return nil, ErrNotFound
+	}
+	return &found, query.Error
+}
+
+func (s *SQLStore) DeleteAlias(url string) error {
+	query := s.db.Where("alias = ?", url).Delete(Alias{})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return query.Error
+}
+
+func (s *SQLStore) Unalias(url string) error {
+	query := s.db.Model(&Alias{}).Where("alias = ?", url).UpdateColumn("unaliased", true)
+	if query.Error == nil && query.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return query.Error
+}
+
+func (s *SQLStore) Original(alias string) (string, error) {
+
+	original, hops, err := resolveAlias(alias, s.lookupAlias)
+	if err != nil {
+		return "", err
+	}
+
+	// The last hop already points at the original
+	if len(hops) > 1 {
+		err := s.db.Model(&Alias{}).Where("alias in (?)", hops[:len(hops)-1]).UpdateColumn("original", original).Error
+		if err != nil {
+			log.Printf("Failed to compress aliases of %s: %s", alias, err)
+		}
+	}
+	return original, nil
+}
+
+// lookupAlias returns what a url is an alias of, leaving out unaliased ones.
+func (s *SQLStore) lookupAlias(url string) (string, error) {
+	var found Alias
+	query := s.db.Where("alias = ? AND unaliased = ?", url, false).First(&found)
+	if query.RecordNotFound() {
+		return "", ErrNotFound
+	}
+	return found.Original, query.Error
+}
+
+func (s *SQLStore) DueFeeds(before time.Time) ([]Feed, error) {
+	var feeds []Feed
+	err := s.db.Select("url, next_poll_at").Where("next_poll_at < ? AND dormant = ?", before, false).Find(&feeds).Error
+	return feeds, err
+}
+
+func (s *SQLStore) Reschedule(urls []string, at time.Time) error {
+	return s.db.Model(&Feed{}).Where("url in (?)", urls).UpdateColumn("next_poll_at", at).Error
+}
+
+func (s *SQLStore) MarkRequested(urls []string, at time.Time) error {
+	return s.db.Model(&Feed{}).Where("url in (?)", urls).UpdateColumns(map[string]interface{}{"requested_at": at, "dormant": false}).Error
+}
+
+// MarkDormant marks feeds in a single statement on postgres. SQLite has no
+// RETURNING in every version, so there they are selected and marked in a
+// transaction, which no other write can come between.
+func (s *SQLStore) MarkDormant(before time.Time) ([]string, error) {
+
+	var urls []string
+	if s.dialect == "postgres" {
+		rows, err := s.db.Raw("UPDATE feed SET dormant = ? WHERE dormant = ? AND requested_at < ? RETURNING url", true, false, before).Rows()
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var url string
+			if err = rows.Scan(&url); err != nil {
+				return nil, err
+			}
+			urls = append(urls, url)
+		}
+		return urls, rows.Err()
+	}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	idle := tx.Model(&Feed{}).Where("dormant = ? AND requested_at < ?", false, before)
+	if err := idle.Pluck("url", &urls).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, tx.Commit().Error
+	}
+	if err := idle.Where("url in (?)", urls).UpdateColumn("dormant", true).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return urls, tx.Commit().Error
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,22 @@
+package nimbus
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteStore keeps feeds in a single SQLite file, for small deployments
+// that would rather not run PostgreSQL.
+func NewSQLiteStore(path string) (*SQLStore, error) {
+
+	db, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only takes one writer at a time
+	db.DB().SetMaxOpenConns(1)
+	db.Exec("PRAGMA journal_mode = WAL")
+
+	return newSQLStore(&db, "sqlite3"), nil
+}
@@ -0,0 +1,278 @@
+package nimbus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+// testStore runs through the life of a feed against any store implementation.
+func testStore(s Store, t *testing.T) {
+
+	defer s.Close()
+
+	now := time.Now().Truncate(time.Second)
+	feed := &Feed{
+		Title:       "xkcd.com",
+		URL:         "http://xkcd.com/rss.xml",
+		Link:        "http://xkcd.com/",
+		Sum:         "sum",
+		NextPollAt:  now.Add(time.Hour),
+		RequestedAt: now,
+		Items: []Item{
+			Item{Title: "Old", GUID: "1", URL: "http://xkcd.com/1/", PublishedAt: now.Add(-2 * time.Hour)},
+			Item{Title: "New", GUID: "2", PublishedAt: now.Add(-time.Hour)},
+			Item{Title: "Repeated", GUID: "2", PublishedAt: now.Add(-time.Hour)},
+		},
+	}
+	if err := s.SaveFeed(feed, nil); err != nil {
+		t.Fatalf("Failed to create feed: %s", err)
+	}
+
+	_, err := s.Feed("http://example.com")
+	expect(err, ErrNotFound, t)
+	stored, err := s.Feed(feed.URL)
+	if err != nil {
+		t.Fatalf("Failed to find feed: %s", err)
+	}
+	expect(stored.ID, feed.ID, t)
+	expect(stored.Title, feed.Title, t)
+	expect(len(stored.Items), 0, t)
+	candidates, err := s.DuplicateCandidates(&Feed{URL: "http://xkcd.com/atom.xml", Items: []Item{Item{GUID: "2"}}}, 10)
+	expect(err, nil, t)
+	expect(len(candidates), 1, t)
+	expect(candidates[0].ID, feed.ID, t)
+	candidates, _ = s.DuplicateCandidates(&Feed{URL: "http://xkcd.com/atom.xml", Link: "https://www.xkcd.com"}, 10)
+	expect(len(candidates), 1, t)
+	candidates, _ = s.DuplicateCandidates(&Feed{URL: "http://xkcd.com/atom.xml", Items: []Item{Item{GUID: "tag:1", URL: "https://xkcd.com/1?utm_source=feed"}}}, 10)
+	expect(len(candidates), 1, t)
+	candidates, _ = s.DuplicateCandidates(&Feed{URL: "http://xkcd.com/atom.xml", Items: []Item{Item{GUID: "3"}}}, 10)
+	expect(len(candidates), 0, t)
+	candidates, _ = s.DuplicateCandidates(feed, 10)
+	expect(len(candidates), 0, t)
+
+	items, _ := s.Items(feed.ID, 0)
+	expect(len(items), 2, t)
+	expect(items[0].Title, "New", t)
+	items, _ = s.Items(feed.ID, 1)
+	expect(len(items), 1, t)
+
+	polled := &Feed{ID: feed.ID, Title: "xkcd.com", URL: feed.URL, Items: []Item{
+		Item{Title: "Newest", GUID: "3", PublishedAt: now},
+		Item{Title: "New, corrected", GUID: "2", PublishedAt: now},
+	}}
+	found := -1
+	expect(s.SaveFeed(polled, func(n int) { found = n }), nil, t)
+	expect(found, 1, t)
+	items, _ = s.Items(feed.ID, 0)
+	expect(len(items), 3, t)
+	expect(items[0].Title, "Newest", t)
+	expect(items[0].FeedID, feed.ID, t)
+	expect(items[1].Title, "New, corrected", t)
+	expect(items[1].PublishedAt.Unix(), now.Add(-time.Hour).Unix(), t)
+	expect(items[0].Updated, false, t)
+	expect(items[1].Updated, true, t)
+
+	item, err := s.Item(feed.ID, "2")
+	expect(err, nil, t)
+	expect(item.Title, "New, corrected", t)
+	expect(item.Updated, true, t)
+	_, err = s.Item(feed.ID, "4")
+	expect(err, ErrNotFound, t)
+	expect(s.SaveFeed(polled, nil), nil, t)
+	polled.Items[1].Title = "New, corrected again"
+	expect(s.SaveFeed(polled, nil), nil, t)
+	revisions, _ := s.Revisions(item.ID)
+	expect(len(revisions), 2, t)
+	expect(revisions[0].Title, "New, corrected", t)
+	expect(revisions[1].Title, "New", t)
+	revisions, _ = s.Revisions(items[0].ID)
+	expect(len(revisions), 0, t)
+
+	results, err := s.Search(SearchQuery{Text: "NEW"})
+	expect(err, nil, t)
+	expect(len(results), 2, t)
+	expect(results[0].Title, "Newest", t)
+	expect(results[0].Feed, feed.URL, t)
+	expect(results[1].Title, "New, corrected again", t)
+	expect(results[1].Updated, true, t)
+	results, _ = s.Search(SearchQuery{Text: "new again"})
+	expect(len(results), 1, t)
+	results, _ = s.Search(SearchQuery{Text: "new", Offset: 1, Limit: 1})
+	expect(len(results), 1, t)
+	expect(results[0].Title, "New, corrected again", t)
+	results, _ = s.Search(SearchQuery{Text: "new", From: now.Add(-time.Minute), To: now.Add(time.Minute)})
+	expect(len(results), 1, t)
+	results, _ = s.Search(SearchQuery{Text: "new", Feeds: []string{feed.URL}})
+	expect(len(results), 2, t)
+	results, _ = s.Search(SearchQuery{Text: "new", Feeds: []string{"http://example.com"}})
+	expect(len(results), 0, t)
+	results, _ = s.Search(SearchQuery{Text: "n%w"})
+	expect(len(results), 0, t)
+	results, _ = s.Search(SearchQuery{Text: " "})
+	expect(len(results), 0, t)
+
+	many := &Feed{ID: feed.ID, Title: "xkcd.com", URL: feed.URL}
+	for i := 0; i < 250; i++ {
+		many.Items = append(many.Items, Item{GUID: fmt.Sprintf("many-%d", i), PublishedAt: now.Add(-time.Duration(i) * time.Hour)})
+	}
+	expect(s.SaveFeed(many, func(n int) { found = n }), nil, t)
+	expect(found, 250, t)
+	items, _ = s.Items(feed.ID, 0)
+	expect(len(items), 253, t)
+	expect(s.SaveFeed(&Feed{ID: feed.ID + 1000, URL: "http://example.com"}, nil) != nil, true, t)
+	items, _ = s.Items(feed.ID, 3)
+	expect(len(items), 3, t)
+	expect(items[0].Title, "Newest", t)
+
+	stored.Title = "xkcd"
+	expect(s.UpdateFeed(stored), nil, t)
+	stored, _ = s.Feed(feed.URL)
+	expect(stored.Title, "xkcd", t)
+	items, _ = s.Items(feed.ID, 0)
+	expect(len(items), 253, t)
+
+	starred := *stored
+	starred.Items = []Item{
+		Item{Title: "Starred", GUID: "starred", PublishedAt: now.Add(-1000 * time.Hour)},
+	}
+	expect(s.SaveFeed(&starred, nil), nil, t)
+	expect(starred.Listed, 1, t)
+	expect(s.StarItem(feed.ID, "starred", true), nil, t)
+	expect(s.StarItem(feed.ID, "missing", true), ErrNotFound, t)
+	expect(s.SaveFeed(&starred, nil), nil, t)
+	starredItem, _ := s.Item(feed.ID, "starred")
+	expect(starredItem.Starred, true, t)
+	pruned, err := s.PruneItems(&starred, Retention{}, 100)
+	expect(err, nil, t)
+	expect(pruned, 0, t)
+	retention := Retention{Keep: 10, MaxAge: 100*time.Hour + 30*time.Minute}
+	pruned, err = s.PruneItems(&starred, retention, 100)
+	expect(err, nil, t)
+	expect(pruned, 100, t)
+	pruned, _ = s.PruneItems(&starred, retention, 100)
+	expect(pruned, 49, t)
+	pruned, _ = s.PruneItems(&starred, Retention{Keep: 50, Floor: 100}, 100)
+	expect(pruned, 4, t)
+	items, _ = s.Items(feed.ID, 0)
+	expect(len(items), 101, t)
+	expect(items[100].Title, "Starred", t)
+
+	listed := &Feed{Title: "Listed", URL: "http://listed.example.com"}
+	for i := 0; i < 5; i++ {
+		listed.Items = append(listed.Items, Item{GUID: fmt.Sprintf("listed-%d", i), PublishedAt: now.Add(-time.Duration(i) * time.Hour)})
+	}
+	expect(s.SaveFeed(listed, nil), nil, t)
+	pruned, _ = s.PruneItems(listed, Retention{Keep: 1}, 100)
+	expect(pruned, 0, t)
+	listed.Items = listed.Items[:2]
+	expect(s.SaveFeed(listed, nil), nil, t)
+	relisted, _ := s.Feed(listed.URL)
+	expect(relisted.Listed, 2, t)
+	pruned, _ = s.PruneItems(relisted, Retention{Keep: 1}, 100)
+	expect(pruned, 3, t)
+	items, _ = s.Items(listed.ID, 0)
+	expect(len(items), 2, t)
+	expect(s.DeleteFeed(relisted), nil, t)
+
+	due, _ := s.DueFeeds(now.Add(time.Minute))
+	expect(len(due), 0, t)
+	expect(s.Reschedule([]string{feed.URL}, now), nil, t)
+	due, _ = s.DueFeeds(now.Add(time.Minute))
+	expect(len(due), 1, t)
+	expect(due[0].URL, feed.URL, t)
+
+	dormant, _ := s.MarkDormant(now.Add(-time.Hour))
+	expect(len(dormant), 0, t)
+	expect(s.MarkRequested([]string{feed.URL}, now.Add(-2*time.Hour)), nil, t)
+	dormant, _ = s.MarkDormant(now.Add(-time.Hour))
+	expect(len(dormant), 1, t)
+	due, _ = s.DueFeeds(now.Add(time.Minute))
+	expect(len(due), 0, t)
+	urls, _ := s.FeedURLs()
+	expect(len(urls), 0, t)
+
+	// Requesting a dormant feed revives it, even if its poll fails
+	expect(s.MarkRequested([]string{feed.URL}, now), nil, t)
+	due, _ = s.DueFeeds(now.Add(time.Minute))
+	expect(len(due), 1, t)
+	dormant, _ = s.MarkDormant(now.Add(-time.Hour))
+	expect(len(dormant), 0, t)
+	expect(s.MarkRequested([]string{feed.URL}, now.Add(-2*time.Hour)), nil, t)
+	s.MarkDormant(now.Add(-time.Hour))
+
+	expect(s.CreateAlias(&Alias{Alias: "http://xkcd.com/atom.xml", Original: feed.URL}), nil, t)
+	expect(s.CreateAlias(&Alias{Alias: "http://xkcd.com/rss", Original: "http://example.com"}), nil, t)
+	aliases, _ := s.Aliases()
+	expect(len(aliases), 2, t)
+	original, err := s.Original("http://xkcd.com/atom.xml")
+	expect(err, nil, t)
+	expect(original, feed.URL, t)
+	_, err = s.Original(feed.URL)
+	expect(err, ErrNotFound, t)
+	results, _ = s.Search(SearchQuery{Text: "newest", Feeds: []string{"http://xkcd.com/atom.xml"}})
+	expect(len(results), 1, t)
+
+	expect(s.DeleteFeed(stored), nil, t)
+	_, err = s.Feed(feed.URL)
+	expect(err, ErrNotFound, t)
+	items, _ = s.Items(feed.ID, 0)
+	expect(len(items), 0, t)
+	revisions, _ = s.Revisions(item.ID)
+	expect(len(revisions), 0, t)
+	aliases, _ = s.Aliases()
+	expect(len(aliases), 1, t)
+	expect(aliases[0].Original, "http://example.com", t)
+
+	// Aliases point at the end of the chain, and never back at themselves
+	expect(s.CreateAlias(&Alias{Alias: "http://a.com", Original: "http://b.com"}), nil, t)
+	expect(s.CreateAlias(&Alias{Alias: "http://b.com", Original: "http://c.com"}), nil, t)
+	alias, err := s.Alias("http://a.com")
+	expect(err, nil, t)
+	expect(alias.Original, "http://c.com", t)
+	alias = &Alias{Alias: "http://d.com", Original: "http://a.com"}
+	expect(s.CreateAlias(alias), nil, t)
+	expect(alias.Original, "http://c.com", t)
+	expect(s.CreateAlias(&Alias{Alias: "http://c.com", Original: "http://a.com"}), ErrAliasCycle, t)
+	original, err = s.Original("http://d.com")
+	expect(err, nil, t)
+	expect(original, "http://c.com", t)
+
+	expect(s.Unalias("http://a.com"), nil, t)
+	_, err = s.Original("http://a.com")
+	expect(err, ErrNotFound, t)
+	alias, _ = s.Alias("http://a.com")
+	expect(alias.Unaliased, true, t)
+	expect(s.CreateAlias(&Alias{Alias: "http://a.com", Original: "http://b.com"}), nil, t)
+	original, _ = s.Original("http://a.com")
+	expect(original, "http://c.com", t)
+
+	expect(s.DeleteAlias("http://a.com"), nil, t)
+	expect(s.DeleteAlias("http://a.com"), ErrNotFound, t)
+	expect(s.Unalias("http://a.com"), ErrNotFound, t)
+	_, err = s.Alias("http://a.com")
+	expect(err, ErrNotFound, t)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nimbus")
+	if err != nil {
+		t.Fatalf("Failed to make directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLiteStore(filepath.Join(dir, "nimbus.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %s", err)
+	}
+	if err = s.Migrate(LatestVersion()); err != nil {
+		t.Fatalf("Failed to migrate store: %s", err)
+	}
+	testStore(s, t)
+}
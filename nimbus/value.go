@@ -0,0 +1,121 @@
+package nimbus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// Value is what is cached for a url: the JSON of its feed, compressed with
+// gzip or not, or a marker. Compressed values are told apart by the magic
+// bytes of gzip, which JSON never starts with.
+type Value []byte
+
+// compressValue compresses the JSON of a feed for caching.
+func compressValue(data []byte) (Value, error) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return Value(compressed.Bytes()), nil
+}
+
+func (v Value) Compressed() bool {
+	return len(v) > 1 && v[0] == 0x1f && v[1] == 0x8b
+}
+
+// marker tells if the value marks a feed as pending or invalid.
+func (v Value) marker() bool {
+	return string(v) == pendingMarker || string(v) == invalidMarker
+}
+
+// JSON returns the value as JSON, decompressing it if needed.
+func (v Value) JSON() (json.RawMessage, error) {
+	if !v.Compressed() {
+		return json.RawMessage(v), nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// WriteValues writes the values as a JSON object of urls, in the order of
+// json.Marshal. Compressed, the object is written as a gzip stream of several
+// members, with the compressed values spliced in as members of their own
+// rather than being decompressed. Only valid JSON is cached compressed, see
+// encodeFeed. Uncompressed, values that can't be decompressed are written as
+// pending and logged.
+func WriteValues(w io.Writer, values map[string]Value, compress bool) error {
+
+	urls := make([]string, 0, len(values))
+	for url := range values {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	// Everything between compressed values is collected and written as one
+	var literal bytes.Buffer
+	var zw *gzip.Writer
+	flush := func() error {
+		if literal.Len() == 0 {
+			return nil
+		}
+		defer literal.Reset()
+		if !compress {
+			_, err := w.Write(literal.Bytes())
+			return err
+		}
+		if zw == nil {
+			zw = gzip.NewWriter(w)
+		} else {
+			zw.Reset(w)
+		}
+		if _, err := zw.Write(literal.Bytes()); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	literal.WriteByte('{')
+	for i, url := range urls {
+		if i > 0 {
+			literal.WriteByte(',')
+		}
+		key, err := json.Marshal(url)
+		if err != nil {
+			return err
+		}
+		literal.Write(key)
+		literal.WriteByte(':')
+
+		value := values[url]
+		if compress && value.Compressed() {
+			if err := flush(); err != nil {
+				return err
+			}
+			if _, err := w.Write(value); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := value.JSON()
+		if err != nil {
+			log.Printf("Writing corrupt value of %s as pending: %s\n", url, err)
+			data = json.RawMessage(pendingMarker)
+		}
+		literal.Write(data)
+	}
+	literal.WriteByte('}')
+	return flush()
+}
@@ -0,0 +1,42 @@
+package nimbus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteValues(t *testing.T) {
+
+	feed, err := encodeFeed("http://xkcd.com/rss.xml", &Feed{Title: "xkcd.com"})
+	expect(err, nil, t)
+	values := map[string]Value{
+		"http://xkcd.com/rss.xml":   Value(feed),
+		"http://example.com":        Value(pendingMarker),
+		"http://example.com/stored": Value(`{"title":"Stored"}`),
+	}
+	expected, _ := Value(feed).JSON()
+	object := `{"http://example.com":true,"http://example.com/stored":{"title":"Stored"},"http://xkcd.com/rss.xml":` + string(expected) + `}`
+
+	var plain bytes.Buffer
+	expect(WriteValues(&plain, values, false), nil, t)
+	expect(plain.String(), object, t)
+
+	// The compressed feed is spliced in between members of its own
+	var compressed bytes.Buffer
+	expect(WriteValues(&compressed, values, true), nil, t)
+	expect(bytes.Contains(compressed.Bytes(), []byte(feed)), true, t)
+	r, err := gzip.NewReader(&compressed)
+	expect(err, nil, t)
+	decompressed, err := ioutil.ReadAll(r)
+	expect(err, nil, t)
+	expect(string(decompressed), object, t)
+
+	// Values that can't be decompressed are written as pending
+	values["http://example.com/corrupt"] = Value(feed[:len(feed)/2])
+	object = `{"http://example.com":true,"http://example.com/corrupt":true,"http://example.com/stored":{"title":"Stored"},"http://xkcd.com/rss.xml":` + string(expected) + `}`
+	plain.Reset()
+	expect(WriteValues(&plain, values, false), nil, t)
+	expect(plain.String(), object, t)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"golang.org/x/net/html/charset"
+	"strings"
 )
 
 type Feed struct {
@@ -13,11 +14,12 @@ type Feed struct {
 }
 
 type Channel struct {
-	Title         string `xml:"title"`
-	TTL           int    `xml:"ttl"`
-	LastBuildDate string `xml:"lastBuildDate"`
-	PubDate       string `xml:"pubDate"`
-	Items         []Item `xml:"item"`
+	Title         string   `xml:"title"`
+	Links         []string `xml:"link"`
+	TTL           int      `xml:"ttl"`
+	LastBuildDate string   `xml:"lastBuildDate"`
+	PubDate       string   `xml:"pubDate"`
+	Items         []Item   `xml:"item"`
 }
 
 type Item struct {
@@ -28,6 +30,17 @@ type Item struct {
 	GUID        string `xml:"guid"`
 }
 
+// Link returns the link of the channel to its site, passing over the empty
+// atom links that channels often carry alongside it.
+func (c Channel) Link() string {
+	for _, link := range c.Links {
+		if link = strings.TrimSpace(link); link != "" {
+			return link
+		}
+	}
+	return ""
+}
+
 func NewFeed(data []byte) (*Feed, error) {
 	if !IsFeed(data) {
 		return nil, fmt.Errorf("Not an RSS feed")
@@ -11,6 +11,7 @@ func TestArsTechnica(t *testing.T) {
 	expected := Feed{
 		Channel: Channel{
 			Title:         "Ars Technica",
+			Links:         []string{"http://arstechnica.com"},
 			LastBuildDate: "Sun, 26 Apr 2015 03:49:47 +0000",
 			Items: []Item{
 				Item{
@@ -30,6 +31,7 @@ func TestXKCD(t *testing.T) {
 	expected := Feed{
 		Channel: Channel{
 			Title: "xkcd.com",
+			Links: []string{"http://xkcd.com/"},
 			Items: []Item{
 				Item{
 					Title:   "Win by Induction",
@@ -71,6 +73,7 @@ func (tc TestCase) TestChannel(t *testing.T) {
 	a := tc.Actual.Channel
 	e := tc.Expected.Channel
 	expect(a.Title, e.Title, t)
+	expect(a.Link(), e.Link(), t)
 	expect(a.TTL, e.TTL, t)
 	expect(a.LastBuildDate, e.LastBuildDate, t)
 	expect(a.PubDate, e.PubDate, t)